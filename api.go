@@ -0,0 +1,166 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NewAPIHandler は監視の状態を JSON で返す API の http.Handler を返す
+func NewAPIHandler(v AutoRejoin) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/clients", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, v.Status())
+	})
+	mux.HandleFunc("/api/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, v.Events())
+	})
+	// ?from=YYYY-MM-DD&to=YYYY-MM-DD&world=...&format=json|csv で履歴を絞り込んで返す
+	mux.HandleFunc("/api/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		q, err := ParseHistoryQuery(query.Get("from"), query.Get("to"), query.Get("world"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		format := query.Get("format")
+		if format == "" {
+			format = "json"
+		}
+		if format != "json" && format != "csv" {
+			http.Error(w, ErrInvalidHistoryFormat.Error(), http.StatusBadRequest)
+			return
+		}
+		records, err := v.History(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		if err := WriteHistory(w, records, format); err != nil {
+			log.Println(err)
+		}
+	})
+	mux.HandleFunc("/api/incidents", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		incidents, err := v.Incidents()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, incidents)
+	})
+	mux.HandleFunc("/api/incidents/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		i, err := v.Incident(strings.TrimPrefix(r.URL.Path, "/api/incidents/"))
+		switch {
+		case errors.Is(err, ErrIncidentNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, i)
+		}
+	})
+	// ?format=text のときはテキストで返す
+	mux.HandleFunc("/api/summary", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		summaries := v.Summaries()
+		if r.URL.Query().Get("format") != "text" {
+			writeJSON(w, summaries)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, s := range summaries {
+			if err := WriteSummary(w, s, "text"); err != nil {
+				log.Println(err)
+			}
+		}
+	})
+	mux.HandleFunc("/api/bookmarks", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, v.Bookmarks())
+	})
+	// POST は {"profile": 0, "target": "..."} で戻るインスタンスを固定し, DELETE は ?profile=0 の固定を外す
+	mux.HandleFunc("/api/pin", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var req PinRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			writePinResult(w, v.Pin(req.Profile, req.Target))
+		case http.MethodDelete:
+			profile, err := strconv.Atoi(r.URL.Query().Get("profile"))
+			if err != nil {
+				http.Error(w, "invalid profile", http.StatusBadRequest)
+				return
+			}
+			writePinResult(w, v.Unpin(profile))
+		default:
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+// PinRequest is the body of POST /api/pin
+type PinRequest struct {
+	Profile int    `json:"profile"`
+	Target  string `json:"target"`
+}
+
+func writePinResult(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrProfileNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ServeAPI は addr で API を待ち受ける
+func ServeAPI(addr string, v AutoRejoin) error {
+	return http.ListenAndServe(addr, NewAPIHandler(v))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(err)
+	}
+}
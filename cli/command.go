@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	vrcarjt "github.com/bootjp/vrc_auto_rejoin_tool"
+)
+
+const usage = `usage:
+  vrc_auto_rejoin_tool                                    start GUI
+  vrc_auto_rejoin_tool patterns test <log>                show log lines matched by log patterns
+  vrc_auto_rejoin_tool pin [-profile N] <instance|url|bookmark>
+                                                          pin the rejoin target of the running tool
+  vrc_auto_rejoin_tool unpin [-profile N]                 unpin the rejoin target of the running tool
+  vrc_auto_rejoin_tool bookmarks                          list bookmarks
+  vrc_auto_rejoin_tool rules explain [-target ID] [-attempts N] [-players a,b] <log line>
+                                                          show which rule fires for the log line
+  vrc_auto_rejoin_tool history [-from YYYY-MM-DD] [-to YYYY-MM-DD] [-world ID|name] [-format text|json|csv]
+                                                          list visited instances and rejoins
+  vrc_auto_rejoin_tool incidents                          list disconnect and rejoin incidents
+  vrc_auto_rejoin_tool incidents show <id>                show an incident with its log excerpt
+`
+
+// runCommand はサブコマンドを実行して終了コードを返す
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	switch {
+	case len(args) == 3 && args[0] == "patterns" && args[1] == "test":
+		return patternsTest(args[2], stdout, stderr)
+	case len(args) >= 1 && args[0] == "pin":
+		return pin(args[1:], stderr)
+	case len(args) >= 1 && args[0] == "unpin":
+		return unpin(args[1:], stderr)
+	case len(args) == 1 && args[0] == "bookmarks":
+		return bookmarks(stdout)
+	case len(args) >= 2 && args[0] == "rules" && args[1] == "explain":
+		return rulesExplain(args[2:], stdout, stderr)
+	case len(args) >= 1 && args[0] == "history":
+		return history(args[1:], stdout, stderr)
+	case len(args) == 1 && args[0] == "incidents":
+		return incidents(stdout, stderr)
+	case len(args) == 3 && args[0] == "incidents" && args[1] == "show":
+		return showIncident(args[2], stdout, stderr)
+	}
+	fmt.Fprint(stderr, usage)
+	return 2
+}
+
+func patternsTest(path string, stdout io.Writer, stderr io.Writer) int {
+	conf := vrcarjt.LoadConf("setting.yml")
+	patterns, err := vrcarjt.NewPatternRegistry(conf.LogPatterns)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	if err := patterns.WriteMatches(stdout, f); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func pin(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("pin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	profile := fs.Int("profile", 0, "profile of the VRChat client")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	body, err := json.Marshal(vrcarjt.PinRequest{Profile: *profile, Target: fs.Arg(0)})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return callAPI(http.MethodPost, "/api/pin", body, stderr)
+}
+
+func unpin(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("unpin", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	profile := fs.Int("profile", 0, "profile of the VRChat client")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+	return callAPI(http.MethodDelete, "/api/pin?profile="+strconv.Itoa(*profile), nil, stderr)
+}
+
+func bookmarks(stdout io.Writer) int {
+	for _, b := range vrcarjt.LoadConf("setting.yml").Bookmarks {
+		fmt.Fprintf(stdout, "%s\t%s\n", b.Name, b.Target)
+	}
+	return 0
+}
+
+func rulesExplain(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("rules explain", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	target := fs.String("target", "", "instance ID to rejoin")
+	attempts := fs.Int("attempts", 0, "number of rejoins so far")
+	players := fs.String("players", "", "comma separated players in the target instance")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	var roster []string
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "players" {
+			roster = []string{}
+			for _, p := range strings.Split(*players, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					roster = append(roster, p)
+				}
+			}
+		}
+	})
+	if err := vrcarjt.ExplainRules(stdout, vrcarjt.LoadConf("setting.yml"), fs.Arg(0), *target, *attempts, roster); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func history(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	from := fs.String("from", "", "first date (YYYY-MM-DD)")
+	to := fs.String("to", "", "last date (YYYY-MM-DD)")
+	world := fs.String("world", "", "world ID or a part of the world name")
+	format := fs.String("format", "text", "text, json or csv")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	q, err := vrcarjt.ParseHistoryQuery(*from, *to, *world)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	records, err := vrcarjt.ReadHistory(vrcarjt.LoadConf("setting.yml").HistoryDir, q)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := vrcarjt.WriteHistory(stdout, records, *format); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func incidents(stdout io.Writer, stderr io.Writer) int {
+	list, err := vrcarjt.ListIncidents(vrcarjt.LoadConf("setting.yml").IncidentDir)
+	if err == nil {
+		err = vrcarjt.WriteIncidentList(stdout, list)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func showIncident(id string, stdout io.Writer, stderr io.Writer) int {
+	i, err := vrcarjt.ReadIncident(vrcarjt.LoadConf("setting.yml").IncidentDir, id)
+	if err == nil {
+		err = vrcarjt.WriteIncident(stdout, i)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// callAPI は起動しているツールの API を呼ぶ. setting.yml の api_listen が必要
+func callAPI(method string, path string, body []byte, stderr io.Writer) int {
+	addr := vrcarjt.LoadConf("setting.yml").APIListen
+	if addr == "" {
+		fmt.Fprintln(stderr, "api_listen is not set in setting.yml")
+		return 1
+	}
+
+	req, err := http.NewRequest(method, "http://"+addr+path, bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		fmt.Fprintf(stderr, "%s: %s", res.Status, msg)
+		return 1
+	}
+	return 0
+}
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	vrcarjt "github.com/bootjp/vrc_auto_rejoin_tool"
@@ -47,8 +52,9 @@ func help(a fyne.App, vrc *vrcarjt.VRCAutoRejoinTool) fyne.CanvasObject {
 func welcomeScreen(a fyne.App, v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasObject {
 	logo.SetMinSize(fyne.NewSize(250, 250))
 	status := widget.NewTextGridFromString("Status: Stop")
+	clients := widget.NewTextGridFromString("")
 	statusContainer := fyne.NewContainerWithLayout(layout.NewCenterLayout(),
-		status,
+		widget.NewVBox(status, clients),
 	)
 	start := widget.NewButton("Start", func() {
 		if v.IsRun() {
@@ -60,14 +66,24 @@ func welcomeScreen(a fyne.App, v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasO
 		}
 
 	})
+	// rejoin した後で監視が止まっていても, summary を作っていない監視があれば Stop できる
 	stop := widget.NewButton("Stop", func() {
-		if !v.IsRun() {
+		if !v.IsRun() && !v.HasSession() {
 			return
 		}
 		if err := v.Stop(); err != nil {
 			fyne.LogError(err.Error(), err)
 			a.Quit()
 		}
+		var summary strings.Builder
+		for _, s := range v.Summaries() {
+			if err := vrcarjt.WriteSummary(&summary, s, "text"); err != nil {
+				fyne.LogError(err.Error(), err)
+			}
+		}
+		if summary.Len() > 0 {
+			dialog.ShowInformation("Summary", summary.String(), w)
+		}
 	})
 	// check status
 	go func() {
@@ -80,8 +96,9 @@ func welcomeScreen(a fyne.App, v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasO
 			case false:
 				status.SetText("Status: Stop")
 				start.Hidden = false
-				stop.Hidden = true
+				stop.Hidden = !v.HasSession()
 			}
+			clients.SetText(clientsText(v.Status()))
 			time.Sleep(1 * time.Second)
 		}
 
@@ -107,8 +124,122 @@ func welcomeScreen(a fyne.App, v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasO
 				stop,
 			),
 		),
+		pinControls(v, w),
+		incidentControls(a, v, w),
+	)
+
+}
+
+// pinControls は戻るインスタンスを instance ID や bookmark で固定する入力欄
+func pinControls(v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasObject {
+	target := widget.NewEntry()
+	target.SetPlaceHolder("instance ID / vrchat://launch URL / launch link")
+	profile := widget.NewEntry()
+	profile.SetText("0")
+
+	var names []string
+	for _, b := range v.Bookmarks() {
+		names = append(names, b.Name)
+	}
+	bookmarks := widget.NewSelect(names, func(name string) {
+		target.SetText(name)
+	})
+	bookmarks.PlaceHolder = "bookmarks"
+
+	profileNumber := func() (int, error) {
+		return strconv.Atoi(strings.TrimSpace(profile.Text))
+	}
+	pin := widget.NewButton("Pin", func() {
+		n, err := profileNumber()
+		if err == nil {
+			err = v.Pin(n, target.Text)
+		}
+		if err != nil {
+			dialog.ShowError(err, w)
+		}
+	})
+	unpin := widget.NewButton("Unpin", func() {
+		n, err := profileNumber()
+		if err == nil {
+			err = v.Unpin(n)
+		}
+		if err != nil {
+			dialog.ShowError(err, w)
+		}
+	})
+
+	return widget.NewGroup("Target",
+		widget.NewForm(
+			widget.NewFormItem("Bookmark", bookmarks),
+			widget.NewFormItem("Target", target),
+			widget.NewFormItem("Profile", profile),
+		),
+		fyne.NewContainerWithLayout(layout.NewGridLayout(2), pin, unpin),
+	)
+}
+
+// incidentControls は保存した incident を選んで別のウインドウに表示する
+func incidentControls(a fyne.App, v vrcarjt.AutoRejoin, w fyne.Window) fyne.CanvasObject {
+	incidents := widget.NewSelect(nil, nil)
+	incidents.PlaceHolder = "incidents"
+	refresh := func() {
+		list, err := v.Incidents()
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		var ids []string
+		for _, i := range list {
+			ids = append(ids, i.ID)
+		}
+		incidents.Options = ids
+		incidents.Refresh()
+	}
+	refresh()
+
+	show := widget.NewButton("Show", func() {
+		i, err := v.Incident(incidents.Selected)
+		if err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		var b strings.Builder
+		if err := vrcarjt.WriteIncident(&b, i); err != nil {
+			dialog.ShowError(err, w)
+			return
+		}
+		report := a.NewWindow("incident " + i.ID)
+		report.SetContent(widget.NewScrollContainer(widget.NewTextGridFromString(b.String())))
+		report.Resize(fyne.NewSize(800, 600))
+		report.Show()
+	})
+
+	return widget.NewGroup("Incidents",
+		incidents,
+		fyne.NewContainerWithLayout(layout.NewGridLayout(2), widget.NewButton("Refresh", refresh), show),
 	)
+}
 
+func clientsText(status []vrcarjt.ClientStatus) string {
+	var lines []string
+	for _, s := range status {
+		state := "Stop"
+		if s.Running {
+			state = "Running"
+		}
+		line := fmt.Sprintf("profile %d (pid %d): %s %s", s.Profile, s.PID, state, s.Target)
+		if s.Pinned {
+			line += " (pinned)"
+		}
+		if s.Instance != "" {
+			line += fmt.Sprintf(" players: %d", len(s.Players))
+		}
+		if c := s.CrashLoop; c != nil && (c.Attempts > 0 || c.GaveUp) {
+			line += fmt.Sprintf(" [rejoins: %d fallback: %s backoff: %ds gave up: %v]", c.Attempts, c.Fallback, c.BackoffSeconds, c.GaveUp)
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
 }
 
 func settingScreen(a fyne.App, vrc *vrcarjt.VRCAutoRejoinTool, w fyne.Window) fyne.CanvasObject {
@@ -160,6 +291,10 @@ func settingScreen(a fyne.App, vrc *vrcarjt.VRCAutoRejoinTool, w fyne.Window) fy
 const lockfile = "vrc_auto_rejoin_tool.rejoinLock"
 
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	vrc := vrcarjt.NewVRCAutoRejoinTool()
 	currentVersion, _ := vrc.GetCurrentVersion()
 	latestVersion, _ := vrc.GetLatestVersion()
@@ -169,8 +304,7 @@ func main() {
 			select {}
 		}
 	}
-	home := vrc.GetUserHome()
-	lock := vrcarjt.NewDupRunLock(home + `\AppData\Local\Temp\` + lockfile)
+	lock := vrcarjt.NewDupRunLock(filepath.Join(os.TempDir(), lockfile))
 	ok, err := lock.Try()
 
 	if err != nil || !ok {
@@ -183,12 +317,19 @@ func main() {
 
 	defer lock.UnLock()
 
+	clients := vrcarjt.NewClientManager()
+	if clients.Config.APIListen != "" {
+		go func() {
+			log.Println(vrcarjt.ServeAPI(clients.Config.APIListen, clients))
+		}()
+	}
+
 	a := app.NewWithID("vrc_auto_rejoin_tool")
 	a.SetIcon(logo.Resource)
 
 	w := a.NewWindow("vrc_auto_rejoin_tool")
 	tabs := widget.NewTabContainer(
-		widget.NewTabItemWithIcon("Control", logo.Resource, welcomeScreen(a, vrc, w)),
+		widget.NewTabItemWithIcon("Control", logo.Resource, welcomeScreen(a, clients, w)),
 		//widget.NewTabItemWithIcon("Setting", logo.Resource, settingScreen(a, vrc, w)),
 	)
 	w.SetContent(tabs)
@@ -0,0 +1,413 @@
+package vrcarjt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gops "github.com/mitchellh/go-ps"
+	"github.com/shirou/gopsutil/process"
+)
+
+// ClientManager は --profile で同時に起動している複数の VRChat をそれぞれ監視する
+type ClientManager struct {
+	Config  *Setting
+	clients []*VRCAutoRejoinTool
+	// pins は profile ごとに固定したインスタンス. Start し直しても引き継ぐ
+	pins    map[int]Instance
+	events  *eventLog
+	history *historyJournal
+	lock    *sync.Mutex
+}
+
+func NewClientManager() *ClientManager {
+	conf := LoadConf("setting.yml")
+	return &ClientManager{
+		Config:  conf,
+		pins:    map[int]Instance{},
+		events:  newEventLog(),
+		history: newHistoryJournal(conf),
+		lock:    &sync.Mutex{},
+	}
+}
+
+type clientProcess struct {
+	PID     int32
+	Profile int
+	Started time.Time
+}
+
+type clientLog struct {
+	Path    string
+	Started time.Time
+}
+
+func (m *ClientManager) Run() error {
+	procs, err := findClientProcesses("VRChat.exe")
+	if err != nil && err != ErrProcessNotFound {
+		return err
+	}
+
+	// VRChat が起動していないときは単体のときと同じく起動を促す
+	if len(procs) == 0 {
+		c := newVRCAutoRejoinTool(m.Config)
+		c.pinned = m.pinned(0)
+		c.events = m.events
+		c.history = m.history
+		m.setClients([]*VRCAutoRejoinTool{c})
+		return c.Run()
+	}
+
+	dir, err := findLogDir(runtime.GOOS, m.GetUserHome(), m.Config.LogDir)
+	if err != nil {
+		return err
+	}
+	loc, err := logLocation(m.Config.LogTimezone)
+	if err != nil {
+		return err
+	}
+	logs, err := findClientLogs(dir, len(procs), loc)
+	if err != nil {
+		return err
+	}
+	matched := matchClientLogs(procs, logs)
+
+	var clients []*VRCAutoRejoinTool
+	for _, p := range procs {
+		if matched[p.PID] == "" {
+			return fmt.Errorf("log file of VRChat (pid %d, profile %d) not found in %s", p.PID, p.Profile, dir)
+		}
+		c := newVRCAutoRejoinTool(m.Config.ForProfile(p.Profile))
+		c.PID = p.PID
+		c.Profile = p.Profile
+		c.LogPath = matched[p.PID]
+		c.pinned = m.pinned(p.Profile)
+		c.events = m.events
+		c.history = m.history
+		c.otherLogs = func() map[string]bool { return m.logsExcept(c) }
+		clients = append(clients, c)
+	}
+	m.setClients(clients)
+
+	for n, c := range clients {
+		if err := c.Run(); err != nil {
+			// 一部のクライアントだけを監視したままにしないよう, 先に始めたクライアントも止める
+			for _, started := range clients[:n] {
+				if err := started.Stop(); err != nil {
+					log.Println(err)
+				}
+			}
+			m.setClients(nil)
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ClientManager) setClients(clients []*VRCAutoRejoinTool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clients = clients
+}
+
+// logsExcept は self 以外のクライアントが監視しているログを返す
+func (m *ClientManager) logsExcept(self *VRCAutoRejoinTool) map[string]bool {
+	used := map[string]bool{}
+	for _, c := range m.Clients() {
+		if c == self {
+			continue
+		}
+		if _, path := c.client(); path != "" {
+			used[path] = true
+		}
+	}
+	return used
+}
+
+func (m *ClientManager) Clients() []*VRCAutoRejoinTool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]*VRCAutoRejoinTool{}, m.clients...)
+}
+
+func (m *ClientManager) IsRun() bool {
+	for _, c := range m.Clients() {
+		if c.IsRun() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ClientManager) HasSession() bool {
+	for _, c := range m.Clients() {
+		if c.HasSession() {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ClientManager) ParseLatestInstance(path string) (Instance, error) {
+	return newVRCAutoRejoinTool(m.Config).ParseLatestInstance(path)
+}
+
+func (m *ClientManager) SleepStart() {
+	for _, c := range m.Clients() {
+		c.SleepStart()
+	}
+}
+
+func (m *ClientManager) Stop() error {
+	for _, c := range m.Clients() {
+		if err := c.Stop(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *ClientManager) GetUserHome() string {
+	return newVRCAutoRejoinTool(m.Config).GetUserHome()
+}
+
+// Pin は profile のクライアントの戻るインスタンスを target に固定する
+// まだ監視していない profile のときは次に Start したときに使う
+func (m *ClientManager) Pin(profile int, target string) error {
+	i, err := resolvePin(target, m.Config.Bookmarks)
+	if err != nil {
+		return err
+	}
+	m.lock.Lock()
+	m.pins[profile] = i
+	m.lock.Unlock()
+
+	for _, c := range m.Clients() {
+		if c.Profile == profile {
+			c.pin(i)
+		}
+	}
+	return nil
+}
+
+func (m *ClientManager) Unpin(profile int) error {
+	m.lock.Lock()
+	delete(m.pins, profile)
+	m.lock.Unlock()
+
+	for _, c := range m.Clients() {
+		if c.Profile == profile {
+			return c.Unpin(profile)
+		}
+	}
+	return nil
+}
+
+func (m *ClientManager) Bookmarks() []Bookmark {
+	return m.Config.Bookmarks
+}
+
+func (m *ClientManager) Events() []Event {
+	return m.events.recent()
+}
+
+func (m *ClientManager) History(q HistoryQuery) ([]HistoryRecord, error) {
+	return ReadHistory(m.Config.HistoryDir, q)
+}
+
+func (m *ClientManager) Incidents() ([]Incident, error) {
+	return ListIncidents(m.Config.IncidentDir)
+}
+
+func (m *ClientManager) Incident(id string) (Incident, error) {
+	return ReadIncident(m.Config.IncidentDir, id)
+}
+
+func (m *ClientManager) Summaries() []SessionSummary {
+	summaries := []SessionSummary{}
+	for _, c := range m.Clients() {
+		summaries = append(summaries, c.Summaries()...)
+	}
+	return summaries
+}
+
+func (m *ClientManager) pinned(profile int) Instance {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.pins[profile]
+}
+
+func (m *ClientManager) Status() []ClientStatus {
+	status := []ClientStatus{}
+	for _, c := range m.Clients() {
+		status = append(status, c.Status()...)
+	}
+	return status
+}
+
+var profileRegexp = regexp.MustCompile(`^--profile=(\d+)$`)
+
+// parseProfile は起動引数の --profile=N を返す. 指定がないときは 0
+func parseProfile(processArgs string) int {
+	for _, arg := range splitCommandLine(processArgs) {
+		m := profileRegexp.FindStringSubmatch(arg)
+		if m == nil {
+			continue
+		}
+		n, err := strconv.Atoi(m[1])
+		if err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+func findClientProcesses(name string) ([]clientProcess, error) {
+	processes, err := gops.Processes()
+	if err != nil {
+		return nil, err
+	}
+
+	var procs []clientProcess
+	for _, p := range processes {
+		if !strings.Contains(p.Executable(), name) {
+			continue
+		}
+		proc, err := process.NewProcess(int32(p.Pid()))
+		if err != nil {
+			continue
+		}
+		args, err := processCommandLine(runtime.GOOS, proc)
+		if err != nil {
+			continue
+		}
+		started := time.Time{}
+		if ms, err := proc.CreateTime(); err == nil {
+			started = time.Unix(0, ms*int64(time.Millisecond))
+		}
+		procs = append(procs, clientProcess{
+			PID:     int32(p.Pid()),
+			Profile: parseProfile(args),
+			Started: started,
+		})
+	}
+
+	if len(procs) == 0 {
+		return nil, ErrProcessNotFound
+	}
+	return procs, nil
+}
+
+// findClientLogs は新しい順に n 個の output_log とその書き始めの時刻を返す
+func findClientLogs(dir string, n int, loc *time.Location) ([]clientLog, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	var logs []clientLog
+	for _, f := range files {
+		if len(logs) >= n {
+			break
+		}
+		if !strings.Contains(f.Name(), "output_log") {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		started, err := readLogStartTime(path, loc)
+		if err != nil {
+			started = f.ModTime()
+		}
+		logs = append(logs, clientLog{Path: path, Started: started})
+	}
+	return logs, nil
+}
+
+// readLogStartTime はログの最初の行の時刻を返す
+func readLogStartTime(path string, loc *time.Location) (time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if t, err := parseLogTime(scanner.Text(), loc); err == nil {
+			return t, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, errLogTimeNotFound
+}
+
+var errLogTimeNotFound = errors.New("log time not found")
+
+// logStartSlack はプロセスの起動からログが作られるまでの時間のずれとして許容する幅
+const logStartSlack = time.Minute
+
+// matchClientLogs は起動した順にプロセスとログを対応付ける
+// プロセスの起動後に最初に書き始められたログをそのプロセスのログとし, 見つからないプロセスは含めない
+func matchClientLogs(procs []clientProcess, logs []clientLog) map[int32]string {
+	procs = append([]clientProcess{}, procs...)
+	sort.Slice(procs, func(i, j int) bool {
+		return procs[i].Started.Before(procs[j].Started)
+	})
+	logs = append([]clientLog{}, logs...)
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Started.Before(logs[j].Started)
+	})
+
+	matched := map[int32]string{}
+	used := make([]bool, len(logs))
+	for _, p := range procs {
+		found := -1
+		for i, l := range logs {
+			if used[i] || l.Started.Before(p.Started.Add(-logStartSlack)) {
+				continue
+			}
+			found = i
+			break
+		}
+		// 時刻で対応付けられないときは他のクライアントのログかもしれないので対応付けない
+		if found < 0 {
+			continue
+		}
+		used[found] = true
+		matched[p.PID] = logs[found].Path
+	}
+	return matched
+}
+
+// relaunchedLog は launched に立ち上げ直した VRChat のログを返す
+// matchClientLogs と同じく, 他のクライアントが使っていないログのうち起動後に最初に書き始められたものにする
+func relaunchedLog(logs []clientLog, launched time.Time, used map[string]bool) (string, bool) {
+	logs = append([]clientLog{}, logs...)
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Started.Before(logs[j].Started)
+	})
+	for _, l := range logs {
+		if used[l.Path] || l.Started.Before(launched.Add(-logStartSlack)) {
+			continue
+		}
+		return l.Path, true
+	}
+	return "", false
+}
@@ -0,0 +1,155 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseProfile(t *testing.T) {
+	tests := []struct {
+		Args   string
+		Expect int
+	}{
+		{`"C:\Program Files (x86)\Steam\steamapps\common\VRChat\VRChat.exe" --no-vr`, 0},
+		{`"C:\Program Files (x86)\Steam\steamapps\common\VRChat\VRChat.exe" --no-vr --profile=2`, 2},
+		{`VRChat.exe "--profile=1" vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d`, 1},
+		{`VRChat.exe --profile=x`, 0},
+	}
+	for _, test := range tests {
+		if got := parseProfile(test.Args); got != test.Expect {
+			t.Errorf("%s expect %d got %d", test.Args, test.Expect, got)
+		}
+	}
+}
+
+func TestParseProfileFromArgv(t *testing.T) {
+	argv := fakeCmdline{`Z:\home\user\Steam Library\steamapps\common\VRChat\VRChat.exe`, "--midi=my keyboard --profile=3", "--profile=2"}
+	args, err := processCommandLine("linux", argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parseProfile(args); got != 2 {
+		t.Errorf("expect 2 got %d", got)
+	}
+}
+
+func TestMatchClientLogs(t *testing.T) {
+	base := time.Date(2021, 2, 14, 22, 0, 0, 0, time.Local)
+	procs := []clientProcess{
+		{PID: 200, Profile: 1, Started: base.Add(30 * time.Minute)},
+		{PID: 100, Profile: 0, Started: base},
+	}
+
+	t.Run("match by start time", func(t *testing.T) {
+		logs := []clientLog{
+			{Path: "output_log_22-30-05.txt", Started: base.Add(30*time.Minute + 5*time.Second)},
+			{Path: "output_log_22-00-03.txt", Started: base.Add(3 * time.Second)},
+		}
+		expect := map[int32]string{100: "output_log_22-00-03.txt", 200: "output_log_22-30-05.txt"}
+		if got := matchClientLogs(procs, logs); !reflect.DeepEqual(got, expect) {
+			t.Errorf("expect %v got %v", expect, got)
+		}
+	})
+
+	t.Run("fewer logs than processes", func(t *testing.T) {
+		logs := []clientLog{
+			{Path: "output_log_22-00-03.txt", Started: base.Add(3 * time.Second)},
+		}
+		expect := map[int32]string{100: "output_log_22-00-03.txt"}
+		if got := matchClientLogs(procs, logs); !reflect.DeepEqual(got, expect) {
+			t.Errorf("expect %v got %v", expect, got)
+		}
+	})
+
+	t.Run("logs older than the processes", func(t *testing.T) {
+		// 他のクライアントのログかもしれない古いログは対応付けない
+		logs := []clientLog{
+			{Path: "output_log_21-00-00.txt", Started: base.Add(-time.Hour)},
+		}
+		expect := map[int32]string{}
+		if got := matchClientLogs(procs, logs); !reflect.DeepEqual(got, expect) {
+			t.Errorf("expect %v got %v", expect, got)
+		}
+	})
+}
+
+func TestRelaunchedLog(t *testing.T) {
+	launched := time.Date(2021, 2, 14, 23, 0, 0, 0, time.Local)
+	logs := []clientLog{
+		{Path: "output_log_23-00-20.txt", Started: launched.Add(20 * time.Second)},
+		{Path: "output_log_23-00-05.txt", Started: launched.Add(5 * time.Second)},
+		{Path: "output_log_22-00-03.txt", Started: launched.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		name   string
+		used   map[string]bool
+		expect string
+	}{
+		{name: "first log after the relaunch", used: map[string]bool{}, expect: "output_log_23-00-05.txt"},
+		{name: "skip the log of another client", used: map[string]bool{"output_log_23-00-05.txt": true}, expect: "output_log_23-00-20.txt"},
+		{name: "no log yet", used: map[string]bool{"output_log_23-00-05.txt": true, "output_log_23-00-20.txt": true}, expect: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, ok := relaunchedLog(logs, launched, test.used)
+			if got != test.expect || ok != (test.expect != "") {
+				t.Errorf("expect %q got %q %v", test.expect, got, ok)
+			}
+		})
+	}
+}
+
+func TestSettingForProfile(t *testing.T) {
+	conf := `
+enable_process_check: yes
+enable_rejoin_notice: yes
+profiles:
+  1:
+    enable_rejoin_notice: no
+`
+	s := Setting{}
+	if err := yaml.Unmarshal([]byte(conf), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	p0 := s.ForProfile(0)
+	if !p0.EnableProcessCheck || !p0.EnableRejoinNotice {
+		t.Errorf("profile 0 must use the base setting %+v", p0)
+	}
+	p1 := s.ForProfile(1)
+	if !p1.EnableProcessCheck || p1.EnableRejoinNotice {
+		t.Errorf("profile 1 must override enable_rejoin_notice %+v", p1)
+	}
+	if !s.EnableRejoinNotice {
+		t.Error("base setting must not be modified")
+	}
+}
+
+func TestAPIClients(t *testing.T) {
+	v := newVRCAutoRejoinTool(defaultSetting)
+	v.PID = 100
+	v.Profile = 1
+	v.LatestInstance = Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d"}
+
+	rec := httptest.NewRecorder()
+	NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/clients", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect %d got %d", http.StatusOK, rec.Code)
+	}
+
+	var got []ClientStatus
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	expect := []ClientStatus{{PID: 100, Profile: 1, Target: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d", Players: []string{}}}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("expect %v got %v", expect, got)
+	}
+}
@@ -0,0 +1,141 @@
+package vrcarjt
+
+import (
+	"strings"
+)
+
+// splitCommandLine は Windows の CommandLineToArgvW と同じ規則でコマンドラインを argv に分割する
+// https://docs.microsoft.com/en-us/cpp/c-language/parsing-c-command-line-arguments
+func splitCommandLine(cmd string) []string {
+	var args []string
+
+	cmd = strings.TrimLeft(cmd, " \t")
+	if cmd == "" {
+		return args
+	}
+
+	// 先頭の実行ファイルのパスはエスケープを解釈せず " の間をそのまま使う
+	var exe string
+	exe, cmd = readExeArg(cmd)
+	args = append(args, exe)
+
+	for {
+		cmd = strings.TrimLeft(cmd, " \t")
+		if cmd == "" {
+			return args
+		}
+		var arg string
+		arg, cmd = readNextArg(cmd)
+		args = append(args, arg)
+	}
+}
+
+func readExeArg(cmd string) (arg string, rest string) {
+	if cmd[0] == '"' {
+		cmd = cmd[1:]
+		if i := strings.IndexByte(cmd, '"'); i >= 0 {
+			return cmd[:i], cmd[i+1:]
+		}
+		return cmd, ""
+	}
+
+	if i := strings.IndexAny(cmd, " \t"); i >= 0 {
+		return cmd[:i], cmd[i+1:]
+	}
+	return cmd, ""
+}
+
+func readNextArg(cmd string) (arg string, rest string) {
+	var b strings.Builder
+	inQuote := false
+	slashes := 0
+
+	for ; len(cmd) > 0; cmd = cmd[1:] {
+		c := cmd[0]
+		switch c {
+		case ' ', '\t':
+			if !inQuote {
+				b.WriteString(strings.Repeat(`\`, slashes))
+				return b.String(), cmd[1:]
+			}
+		case '"':
+			// 2n 個の \ と " は n 個の \ と クォートの開始/終了
+			// 2n+1 個の \ と " は n 個の \ と " そのもの
+			b.WriteString(strings.Repeat(`\`, slashes/2))
+			if slashes%2 == 0 {
+				// クォート中の "" は " そのものとして扱いクォートを閉じる (2008年以前の規則)
+				if inQuote && len(cmd) > 1 && cmd[1] == '"' {
+					b.WriteByte('"')
+					cmd = cmd[1:]
+				}
+				inQuote = !inQuote
+			} else {
+				b.WriteByte('"')
+			}
+			slashes = 0
+			continue
+		case '\\':
+			slashes++
+			continue
+		}
+		b.WriteString(strings.Repeat(`\`, slashes))
+		slashes = 0
+		b.WriteByte(c)
+	}
+
+	b.WriteString(strings.Repeat(`\`, slashes))
+	return b.String(), ""
+}
+
+// joinCommandLine は splitCommandLine で元の argv に戻るようにクォートしてコマンドラインを組み立てる
+func joinCommandLine(args []string) string {
+	var b strings.Builder
+	for i, arg := range args {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		if i == 0 {
+			b.WriteString(quoteExeArg(arg))
+			continue
+		}
+		b.WriteString(quoteArg(arg))
+	}
+	return b.String()
+}
+
+func quoteExeArg(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// quoteArg は syscall.EscapeArg と同じ規則で引数をクォートする
+func quoteArg(s string) string {
+	if s == "" {
+		return `""`
+	}
+	if !strings.ContainsAny(s, " \t\"") {
+		return s
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			b.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		b.WriteByte(c)
+	}
+	b.WriteString(strings.Repeat(`\`, slashes))
+	b.WriteByte('"')
+	return b.String()
+}
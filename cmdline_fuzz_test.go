@@ -0,0 +1,42 @@
+//go:build go1.18
+// +build go1.18
+
+package vrcarjt
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func FuzzCommandLineRoundTrip(f *testing.F) {
+	f.Add("VRChat.exe\x00--no-vr")
+	f.Add("C:\\Program Files (x86)\\VRChat\\VRChat.exe\x00--midi=My Device\x00\x00a\\\"b\\")
+	f.Fuzz(func(t *testing.T, s string) {
+		args := strings.Split(s, "\x00")
+		// 実行ファイルのパスは空文字や " を含むものを表現できない
+		if args[0] == "" || strings.Contains(args[0], `"`) {
+			t.Skip()
+		}
+		cmd := joinCommandLine(args)
+		if got := splitCommandLine(cmd); !reflect.DeepEqual(got, args) {
+			t.Fatalf("round trip failed %q \nexpect %q \ngot %q", cmd, args, got)
+		}
+	})
+}
+
+func FuzzPrepareExecArgs(f *testing.F) {
+	f.Add(`"C:\Program Files (x86)\Steam\steamapps\common\VRChat\VRChat.exe" --no-vr --enable-sdk-log-levels`, "wrld_cc124ed6-acec-4d55-9866-54ab66af172d")
+	f.Add(`S:\SteamLibrary\steamapps\common\VRChat\VRChat.exe --no-vr vrchat://launch?id=wrld_bd543f66-8bf1-4ddb-bfc0-5a088d486e0c:45704"`, "wrld_d95af561-c0d2-4000-b269-7e1913aec432:10484")
+	f.Fuzz(func(t *testing.T, processArgs string, id string) {
+		res := prepareExecArgs(processArgs, Instance{ID: id})
+		if len(res.Args) == 0 || res.Args[len(res.Args)-1] != "vrchat://launch?id="+id {
+			t.Fatalf("launch arg must be last %q", res.Args)
+		}
+		for _, arg := range res.Args[:len(res.Args)-1] {
+			if strings.HasPrefix(strings.ToLower(arg), launchScheme) {
+				t.Fatalf("launch arg must be removed %q", res.Args)
+			}
+		}
+	})
+}
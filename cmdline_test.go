@@ -0,0 +1,65 @@
+package vrcarjt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Cmd    string
+		Expect []string
+	}{
+		{"empty", ``, nil},
+		{"exe only", `VRChat.exe`, []string{`VRChat.exe`}},
+		{"quoted exe", `"C:\Program Files\VRChat\VRChat.exe" --no-vr`, []string{`C:\Program Files\VRChat\VRChat.exe`, `--no-vr`}},
+		{"exe keeps backslash before quote", `"C:\VRChat\"x --no-vr`, []string{`C:\VRChat\`, `x`, `--no-vr`}},
+		{"leading and repeated spaces", "  a.exe \t b   c ", []string{`a.exe`, `b`, `c`}},
+		{"quoted arg", `a.exe "b c" d`, []string{`a.exe`, `b c`, `d`}},
+		{"quote in the middle", `a.exe --midi="My Device"`, []string{`a.exe`, `--midi=My Device`}},
+		{"escaped quote", `a.exe \"b`, []string{`a.exe`, `"b`}},
+		{"backslashes not before quote", `a.exe C:\a\\b\`, []string{`a.exe`, `C:\a\\b\`}},
+		{"even backslashes before quote", `a.exe "C:\a\\" b`, []string{`a.exe`, `C:\a\`, `b`}},
+		{"odd backslashes before quote", `a.exe "a\\\"b"`, []string{`a.exe`, `a\"b`}},
+		{"double quote in quote", `a.exe "a""b" c`, []string{`a.exe`, `a"b c`}},
+		{"empty arg", `a.exe "" b`, []string{`a.exe`, ``, `b`}},
+		{"unterminated quote", `a.exe "b c`, []string{`a.exe`, `b c`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got := splitCommandLine(test.Cmd)
+			if !reflect.DeepEqual(got, test.Expect) {
+				t.Errorf("doesnt match \nexpect %q \ngot %q", test.Expect, got)
+			}
+		})
+	}
+}
+
+func TestJoinCommandLine(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Args   []string
+		Expect string
+	}{
+		{"plain", []string{`a.exe`, `b`}, `a.exe b`},
+		{"exe with space", []string{`C:\Program Files\a.exe`, `b`}, `"C:\Program Files\a.exe" b`},
+		{"arg with space", []string{`a.exe`, `--midi=My Device`}, `a.exe "--midi=My Device"`},
+		{"arg with quote", []string{`a.exe`, `a"b`}, `a.exe "a\"b"`},
+		{"arg with trailing backslash", []string{`a.exe`, `C:\a b\`}, `a.exe "C:\a b\\"`},
+		{"empty arg", []string{`a.exe`, ``}, `a.exe ""`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got := joinCommandLine(test.Args)
+			if got != test.Expect {
+				t.Errorf("doesnt match \nexpect %q \ngot %q", test.Expect, got)
+			}
+			if back := splitCommandLine(got); !reflect.DeepEqual(back, test.Args) {
+				t.Errorf("round trip failed \nexpect %q \ngot %q", test.Args, back)
+			}
+		})
+	}
+}
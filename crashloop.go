@@ -0,0 +1,229 @@
+package vrcarjt
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LaunchProfile は crash loop のときに起動引数や入るワールドを変えて立ち上げ直すための設定
+type LaunchProfile struct {
+	Name string `yaml:"name"`
+	// AddArgs は起動引数に追加する. RemoveArgs は一致するか "引数=" で始まる起動引数を取り除く
+	AddArgs    []string `yaml:"add_args"`
+	RemoveArgs []string `yaml:"remove_args"`
+	// World が指定されているときは元のインスタンスの代わりにこのワールドに入る
+	World string `yaml:"world"`
+}
+
+// CrashLoopSetting は rejoin を繰り返しても落ち続けるときの振る舞い
+type CrashLoopSetting struct {
+	// VRChat が落ちるか固まる, または rejoin したインスタンスに入れないことが WindowMinutes 分の間に MaxRejoins 回起きたら crash loop とみなす
+	// 0 のときは判定しない. 立ち上げ直した後も監視を続ける enable_daemon のときだけ使える
+	// WindowMinutes が 0 のときは 30 分とする
+	MaxRejoins    int             `yaml:"max_rejoins"`
+	WindowMinutes int             `yaml:"window_minutes"`
+	Fallbacks     []LaunchProfile `yaml:"fallbacks"`
+}
+
+// CrashLoopStatus is the crash loop circuit breaker state of a VRChat client
+type CrashLoopStatus struct {
+	Attempts       int    `json:"attempts"`
+	Fallback       string `json:"fallback"`
+	BackoffSeconds int    `json:"backoff_seconds"`
+	GaveUp         bool   `json:"gave_up"`
+}
+
+func (p LaunchProfile) apply(e Exec) Exec {
+	args := make([]string, 0, len(e.Args)+len(p.AddArgs))
+	for _, arg := range e.Args {
+		if !p.removes(arg) {
+			args = append(args, arg)
+		}
+	}
+
+	// vrchat://launch は最後に置いたままにする
+	if n := len(args); n > 0 && strings.HasPrefix(args[n-1], launchScheme) {
+		launch := args[n-1]
+		args = append(append(args[:n-1:n-1], p.AddArgs...), launch)
+	} else {
+		args = append(args, p.AddArgs...)
+	}
+
+	return Exec{ExePath: e.ExePath, Args: args}
+}
+
+func (p LaunchProfile) removes(arg string) bool {
+	for _, r := range p.RemoveArgs {
+		if arg == r || strings.HasPrefix(arg, r+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	crashLoopBackoffBase   = 30 * time.Second
+	crashLoopBackoffMax    = 10 * time.Minute
+	crashLoopDefaultWindow = 30 * time.Minute
+)
+
+// crashLoopBreaker は短い間に VRChat が落ちたり rejoin に失敗したりを繰り返していないかを数え,
+// 繰り返しているときは fallbacks の起動プロファイルを順に試す. 切断からの普通の rejoin は数えない
+type crashLoopBreaker struct {
+	clock     clock
+	max       int
+	window    time.Duration
+	fallbacks []LaunchProfile
+
+	lock     *sync.Mutex
+	failures []time.Time
+	level    int
+	gaveUp   bool
+}
+
+func newCrashLoopBreaker(c clock, conf CrashLoopSetting) *crashLoopBreaker {
+	// window が 0 だと失敗を数える前に消してしまい, max_rejoins を指定しても働かない
+	window := time.Duration(conf.WindowMinutes) * time.Minute
+	if window <= 0 {
+		window = crashLoopDefaultWindow
+	}
+	return &crashLoopBreaker{
+		clock:     c,
+		max:       conf.MaxRejoins,
+		window:    window,
+		fallbacks: conf.Fallbacks,
+		lock:      &sync.Mutex{},
+	}
+}
+
+// failed は VRChat が落ちたか固まったこと, または rejoin したインスタンスに入れなかったことを 1 回記録する
+func (b *crashLoopBreaker) failed() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.max <= 0 {
+		return
+	}
+	b.prune()
+	b.failures = append(b.failures, b.clock.Now())
+}
+
+// attempt は rejoin する前に, 使う起動プロファイルと rejoin までに待つ時間を返す
+// 全ての fallback でも落ち続けたときは false を返す
+func (b *crashLoopBreaker) attempt() (LaunchProfile, time.Duration, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.max <= 0 {
+		return LaunchProfile{}, 0, true
+	}
+	if b.gaveUp {
+		return LaunchProfile{}, 0, false
+	}
+
+	b.prune()
+	if len(b.failures) >= b.max {
+		b.level++
+		b.failures = nil
+		if b.level > len(b.fallbacks) {
+			b.gaveUp = true
+			return LaunchProfile{}, 0, false
+		}
+	}
+
+	return b.profile(), b.backoff(), true
+}
+
+// recovered は rejoin できたことを確かめたときに fallback を元の起動プロファイルに戻す
+// 入れた後に落ちるのを繰り返すときに数えられるよう, 失敗の記録は残す
+func (b *crashLoopBreaker) recovered() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.level = 0
+}
+
+func (b *crashLoopBreaker) reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = nil
+	b.level = 0
+	b.gaveUp = false
+}
+
+func (b *crashLoopBreaker) prune() {
+	now := b.clock.Now()
+	var failures []time.Time
+	for _, at := range b.failures {
+		if now.Sub(at) < b.window {
+			failures = append(failures, at)
+		}
+	}
+	b.failures = failures
+}
+
+// backoff は直近の失敗の回数に応じて倍々に伸ばした待ち時間. 1 回目の失敗のときは待たない
+func (b *crashLoopBreaker) backoff() time.Duration {
+	if len(b.failures) <= 1 {
+		return 0
+	}
+	d := crashLoopBackoffBase << uint(len(b.failures)-2)
+	if d > crashLoopBackoffMax || d <= 0 {
+		return crashLoopBackoffMax
+	}
+	return d
+}
+
+func (b *crashLoopBreaker) profile() LaunchProfile {
+	if b.level == 0 || b.level > len(b.fallbacks) {
+		return LaunchProfile{}
+	}
+	return b.fallbacks[b.level-1]
+}
+
+func (b *crashLoopBreaker) status() *CrashLoopStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.max <= 0 {
+		return nil
+	}
+	b.prune()
+	return &CrashLoopStatus{
+		Attempts:       len(b.failures),
+		Fallback:       b.profile().Name,
+		BackoffSeconds: int(b.backoff() / time.Second),
+		GaveUp:         b.gaveUp,
+	}
+}
+
+// crashLoopState は状態ファイルに保存する crash loop の状態
+type crashLoopState struct {
+	Attempts []time.Time `json:"attempts,omitempty"`
+	Level    int         `json:"level"`
+	GaveUp   bool        `json:"gave_up"`
+}
+
+func (b *crashLoopBreaker) snapshot() crashLoopState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return crashLoopState{
+		Attempts: append([]time.Time{}, b.failures...),
+		Level:    b.level,
+		GaveUp:   b.gaveUp,
+	}
+}
+
+func (b *crashLoopBreaker) restore(s crashLoopState) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = append([]time.Time{}, s.Attempts...)
+	b.level = s.Level
+	b.gaveUp = s.GaveUp
+	b.prune()
+}
+
+// currentProfile は今使っている起動プロファイルを返す
+func (b *crashLoopBreaker) currentProfile() LaunchProfile {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.profile()
+}
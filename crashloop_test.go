@@ -0,0 +1,137 @@
+package vrcarjt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLaunchProfileApply(t *testing.T) {
+	e := Exec{
+		ExePath: `C:\VRChat\VRChat.exe`,
+		Args:    []string{"--fps=144", "--enable-debug-gui", "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+	}
+	p := LaunchProfile{Name: "safe", AddArgs: []string{"--no-vr", "--fps=30"}, RemoveArgs: []string{"--fps", "--enable-debug-gui"}}
+
+	expect := Exec{
+		ExePath: `C:\VRChat\VRChat.exe`,
+		Args:    []string{"--no-vr", "--fps=30", "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+	}
+	if got := p.apply(e); !reflect.DeepEqual(got, expect) {
+		t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+	}
+	if len(e.Args) != 3 || e.Args[0] != "--fps=144" {
+		t.Errorf("original args must not be modified %q", e.Args)
+	}
+}
+
+func TestCrashLoopBreaker(t *testing.T) {
+	c := &fakeClock{now: time.Date(2021, 2, 14, 2, 0, 0, 0, time.Local)}
+
+	t.Run("disabled", func(t *testing.T) {
+		b := newCrashLoopBreaker(c, CrashLoopSetting{})
+		for i := 0; i < 10; i++ {
+			if _, _, ok := b.attempt(); !ok {
+				t.Fatal("must not give up when disabled")
+			}
+		}
+		if b.status() != nil {
+			t.Error("status must be nil when disabled")
+		}
+	})
+
+	t.Run("rejoins without failure are not counted", func(t *testing.T) {
+		b := newCrashLoopBreaker(c, CrashLoopSetting{MaxRejoins: 2, WindowMinutes: 30, Fallbacks: []LaunchProfile{{Name: "no-vr"}}})
+		for i := 0; i < 10; i++ {
+			if p, backoff, ok := b.attempt(); !ok || p.Name != "" || backoff != 0 {
+				t.Fatalf("attempt %d must not be crash loop", i)
+			}
+			c.Sleep(time.Minute)
+		}
+	})
+
+	t.Run("fallbacks then give up", func(t *testing.T) {
+		b := newCrashLoopBreaker(c, CrashLoopSetting{
+			MaxRejoins:    3,
+			WindowMinutes: 30,
+			Fallbacks:     []LaunchProfile{{Name: "no-vr", AddArgs: []string{"--no-vr"}}, {Name: "fallback world", World: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"}},
+		})
+
+		expect := []struct {
+			profile string
+			backoff time.Duration
+		}{
+			{"", 0},
+			{"", 30 * time.Second},
+			{"no-vr", 0},
+			{"no-vr", 0},
+			{"no-vr", 30 * time.Second},
+			{"fallback world", 0},
+			{"fallback world", 0},
+			{"fallback world", 30 * time.Second},
+		}
+		for i, e := range expect {
+			b.failed()
+			p, backoff, ok := b.attempt()
+			if !ok || p.Name != e.profile || backoff != e.backoff {
+				t.Fatalf("attempt %d expect %q %s got %q %s %v", i, e.profile, e.backoff, p.Name, backoff, ok)
+			}
+			c.Sleep(time.Minute)
+		}
+
+		b.failed()
+		if _, _, ok := b.attempt(); ok {
+			t.Fatal("must give up after all fallbacks")
+		}
+		if s := b.status(); !s.GaveUp {
+			t.Errorf("status must be gave up %+v", s)
+		}
+
+		b.reset()
+		if p, _, ok := b.attempt(); !ok || p.Name != "" {
+			t.Error("must rejoin normally after reset")
+		}
+	})
+
+	t.Run("back to the normal profile after a verified rejoin", func(t *testing.T) {
+		v := newVRCAutoRejoinTool(&Setting{CrashLoop: CrashLoopSetting{MaxRejoins: 1, WindowMinutes: 30, Fallbacks: []LaunchProfile{{Name: "no-vr"}}}})
+		v.clock = c
+		v.crashLoop = newCrashLoopBreaker(c, v.Config.CrashLoop)
+		v.playSound = func(string) {}
+		v.LatestInstance = Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"}
+		v.crashLoop.failed()
+		if p, _, _ := v.crashLoop.attempt(); p.Name != "no-vr" {
+			t.Fatalf("expect the fallback profile got %q", p.Name)
+		}
+		v.verifyRejoin(v.LatestInstance)
+		if p := v.crashLoop.currentProfile(); p.Name != "" {
+			t.Errorf("fallback must be reset after a verified rejoin got %q", p.Name)
+		}
+	})
+
+	t.Run("default window", func(t *testing.T) {
+		b := newCrashLoopBreaker(c, CrashLoopSetting{MaxRejoins: 2, Fallbacks: []LaunchProfile{{Name: "no-vr"}}})
+		b.failed()
+		c.Sleep(time.Minute)
+		b.failed()
+		if p, _, ok := b.attempt(); !ok || p.Name != "no-vr" {
+			t.Errorf("window_minutes 0 must use the default window %v %v", p, ok)
+		}
+	})
+
+	t.Run("failures expire after window", func(t *testing.T) {
+		b := newCrashLoopBreaker(c, CrashLoopSetting{MaxRejoins: 3, WindowMinutes: 30, Fallbacks: []LaunchProfile{{Name: "no-vr"}}})
+		for i := 0; i < 5; i++ {
+			b.failed()
+			if p, _, ok := b.attempt(); !ok || p.Name != "" {
+				t.Fatalf("attempt %d must not be crash loop", i)
+			}
+			c.Sleep(20 * time.Minute)
+		}
+		b.failed()
+		expect := &CrashLoopStatus{Attempts: 2, BackoffSeconds: 30}
+		if s := b.status(); !reflect.DeepEqual(s, expect) {
+			t.Errorf("expect %+v got %+v", expect, s)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package vrcarjt
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// EventType is a kind of event published by the tool
+type EventType string
+
+const (
+	// EventRetarget は戻るインスタンスが変わったときのイベント
+	EventRetarget EventType = "retarget"
+	// EventPlayerJoin, EventPlayerLeave はインスタンスにいるプレイヤーが変わったときのイベント
+	EventPlayerJoin  EventType = "player_joined"
+	EventPlayerLeave EventType = "player_left"
+	// EventModeration はキックや BAN で rejoin しなかったときのイベント
+	EventModeration EventType = "moderation"
+	// EventJoinFailed は rejoin したインスタンスに入れなかったときのイベント. Reason に理由が入る
+	EventJoinFailed EventType = "join_failed"
+)
+
+// Event is something which happened while monitoring a VRChat client
+type Event struct {
+	Time     time.Time `json:"time"`
+	Profile  int       `json:"profile"`
+	Type     EventType `json:"type"`
+	Instance string    `json:"instance,omitempty"`
+	Message  string    `json:"message"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// maxEvents は保持しておく直近のイベントの数
+const maxEvents = 200
+
+// eventLog は直近のイベントを保持する. ClientManager では全てのクライアントで共有する
+type eventLog struct {
+	lock   *sync.Mutex
+	events []Event
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{lock: &sync.Mutex{}}
+}
+
+func (l *eventLog) add(e Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, e)
+	if len(l.events) > maxEvents {
+		l.events = append([]Event{}, l.events[len(l.events)-maxEvents:]...)
+	}
+}
+
+// recent は古い順にイベントを返す
+func (l *eventLog) recent() []Event {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	events := append([]Event{}, l.events...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	return events
+}
+
+// publish はイベントを記録してログに出す
+func (v *VRCAutoRejoinTool) publish(t EventType, instance string, message string) {
+	v.emit(Event{Time: v.clock.Now(), Profile: v.Profile, Type: t, Instance: instance, Message: message})
+}
+
+// emit は組み立てたイベントを記録して通知する
+func (v *VRCAutoRejoinTool) emit(e Event) {
+	v.events.add(e)
+	v.notify(string(e.Type), e.Message)
+}
+
+// record はイベントを記録するだけで通知はしない. プレイヤーの出入りのように頻繁に起きるイベントに使う
+func (v *VRCAutoRejoinTool) record(t EventType, instance string, message string) {
+	v.events.add(Event{Time: v.clock.Now(), Profile: v.Profile, Type: t, Instance: instance, Message: message})
+}
+
+func (v *VRCAutoRejoinTool) Events() []Event {
+	return v.events.recent()
+}
@@ -0,0 +1,71 @@
+package vrcarjt
+
+import (
+	"log"
+	"time"
+)
+
+// followCheckInterval は follow_latest_minutes の間同じインスタンスにいるかを確かめる間隔
+const followCheckInterval = 10 * time.Second
+
+// retarget は戻るインスタンスを i に変えて, イベントを出して専用の音を鳴らす
+func (v *VRCAutoRejoinTool) retarget(i Instance, reason string) {
+	v.targetLock.Lock()
+	v.LatestInstance = i
+	v.targetLock.Unlock()
+	v.rejoinLock.Lock()
+	v.candidate = Instance{}
+	v.rejoinLock.Unlock()
+
+	v.saveState(true)
+	v.publish(EventRetarget, i.ID, "target instance changed to "+i.ID+" ("+reason+")")
+	go v.playSound("retarget.wav")
+}
+
+// settle は自分で移動したインスタンスを follow_latest_minutes の間いたら戻るインスタンスにする候補として記録する
+// follow_latest_minutes が 0 のときはすぐに戻るインスタンスにする
+func (v *VRCAutoRejoinTool) settle(i Instance, reason string) {
+	if v.Config.FollowLatestMinutes <= 0 {
+		v.retarget(i, reason)
+		return
+	}
+
+	log.Println("waiting", v.Config.FollowLatestMinutes, "minutes before following", i.ID)
+	v.rejoinLock.Lock()
+	v.candidate = i
+	v.candidateSince = v.clock.Now()
+	v.rejoinLock.Unlock()
+}
+
+// cancelCandidate は候補のインスタンスから離れたときに候補を消す
+func (v *VRCAutoRejoinTool) cancelCandidate() {
+	v.rejoinLock.Lock()
+	defer v.rejoinLock.Unlock()
+	if v.candidate.ID != "" {
+		log.Println("left", v.candidate.ID, "before following it")
+	}
+	v.candidate = Instance{}
+}
+
+// confirmCandidate は候補のインスタンスに follow_latest_minutes の間いたときに戻るインスタンスにする
+func (v *VRCAutoRejoinTool) confirmCandidate() bool {
+	wait := time.Duration(v.Config.FollowLatestMinutes) * time.Minute
+
+	v.rejoinLock.Lock()
+	candidate := v.candidate
+	settled := candidate.ID != "" && v.clock.Now().Sub(v.candidateSince) >= wait
+	v.rejoinLock.Unlock()
+
+	if !settled {
+		return false
+	}
+	v.retarget(candidate, "stayed "+wait.String())
+	return true
+}
+
+func (v *VRCAutoRejoinTool) followWatcher(generation int) {
+	for v.isWatching(generation) {
+		v.confirmCandidate()
+		v.clock.Sleep(followCheckInterval)
+	}
+}
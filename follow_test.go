@@ -0,0 +1,92 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFollowLatest(t *testing.T) {
+	start := Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"}
+	next := Instance{ID: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"}
+
+	newTool := func(minutes int) (*VRCAutoRejoinTool, *fakeClock, chan string) {
+		c := &fakeClock{now: time.Date(2021, 2, 14, 1, 0, 0, 0, time.UTC)}
+		v := newVRCAutoRejoinTool(&Setting{FollowLatestMinutes: minutes})
+		v.clock = c
+		v.LatestInstance = start
+		sounds := make(chan string, 1)
+		v.playSound = func(path string) { sounds <- path }
+		return v, c, sounds
+	}
+
+	t.Run("retarget after confirmation", func(t *testing.T) {
+		v, c, sounds := newTool(10)
+		v.settle(next, "entered portal")
+
+		c.Sleep(5 * time.Minute)
+		if v.confirmCandidate() || v.LatestInstance != start {
+			t.Fatal("must wait for confirmation")
+		}
+		c.Sleep(5 * time.Minute)
+		if !v.confirmCandidate() {
+			t.Fatal("must retarget after confirmation")
+		}
+		if v.LatestInstance != next {
+			t.Errorf("expect %v got %v", next, v.LatestInstance)
+		}
+
+		events := v.Events()
+		if len(events) != 1 || events[0].Type != EventRetarget || events[0].Instance != next.ID {
+			t.Errorf("unexpected events %+v", events)
+		}
+		select {
+		case s := <-sounds:
+			if s != "retarget.wav" {
+				t.Errorf("unexpected sound %q", s)
+			}
+		case <-time.After(time.Second):
+			t.Error("retarget sound not played")
+		}
+	})
+
+	t.Run("left before confirmation", func(t *testing.T) {
+		v, c, _ := newTool(10)
+		v.settle(next, "entered portal")
+		c.Sleep(3 * time.Minute)
+		v.cancelCandidate()
+		c.Sleep(10 * time.Minute)
+		if v.confirmCandidate() || v.LatestInstance != start {
+			t.Error("must not retarget after leaving the candidate")
+		}
+		if len(v.Events()) != 0 {
+			t.Errorf("unexpected events %+v", v.Events())
+		}
+	})
+
+	t.Run("immediately without follow_latest_minutes", func(t *testing.T) {
+		v, _, _ := newTool(0)
+		v.settle(next, "joined from menu")
+		if v.LatestInstance != next {
+			t.Errorf("expect %v got %v", next, v.LatestInstance)
+		}
+	})
+}
+
+func TestAPIEvents(t *testing.T) {
+	v := newVRCAutoRejoinTool(&Setting{})
+	v.clock = &fakeClock{now: time.Date(2021, 2, 14, 1, 0, 0, 0, time.UTC)}
+	v.publish(EventRetarget, "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f", "target instance changed")
+
+	rec := httptest.NewRecorder()
+	NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/events", nil))
+	var got []Event
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Type != EventRetarget || !got[0].Time.Equal(v.clock.Now()) {
+		t.Errorf("unexpected events %+v", got)
+	}
+}
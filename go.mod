@@ -6,16 +6,14 @@ require (
 	fyne.io/fyne v1.3.0
 	github.com/StackExchange/wmi v0.0.0-20190523213315-cbe66965904d // indirect
 	github.com/faiface/beep v1.0.2
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-ole/go-ole v1.2.4 // indirect
 	github.com/gofrs/flock v0.7.1
-	github.com/hpcloud/tail v1.0.0
 	github.com/jinzhu/now v1.1.1
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/shirou/gopsutil v2.20.3+incompatible
 	github.com/stretchr/testify v1.6.1 // indirect
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4 // indirect
-	gopkg.in/fsnotify.v1 v1.4.7 // indirect
-	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	golang.org/x/sys v0.0.0-20210119212857-b64e53b001e4
 	gopkg.in/yaml.v2 v2.2.8
 )
@@ -0,0 +1,455 @@
+package vrcarjt
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HistoryKind is a kind of record in the visit history
+type HistoryKind string
+
+const (
+	// HistoryEnter, HistoryExit はインスタンスに入ったとき, 出たときの記録
+	HistoryEnter HistoryKind = "enter"
+	HistoryExit  HistoryKind = "exit"
+	// HistoryWorldName はログに出たワールド名の記録. 読み出すときは同じワールドの記録にまとめる
+	HistoryWorldName HistoryKind = "world_name"
+	// HistoryDisconnect は切断などを検出して rejoin するかを決めたときの記録
+	HistoryDisconnect HistoryKind = "disconnect"
+	// HistoryRejoin は rejoin したインスタンスに入れたかの記録
+	HistoryRejoin HistoryKind = "rejoin"
+)
+
+// ErrInvalidHistoryFormat is returned when the export format is unknown
+var ErrInvalidHistoryFormat = errors.New("format must be text, json or csv")
+
+// historyDateFormat は履歴のファイル名と絞り込みの日付の形式
+const historyDateFormat = "2006-01-02"
+
+// HistoryRecord is an entry of the visit history
+type HistoryRecord struct {
+	Time       time.Time   `json:"time"`
+	Profile    int         `json:"profile"`
+	Kind       HistoryKind `json:"kind"`
+	Instance   string      `json:"instance,omitempty"`
+	WorldName  string      `json:"world_name,omitempty"`
+	AccessType string      `json:"access_type,omitempty"`
+	Cause      RejoinCause `json:"cause,omitempty"`
+	Outcome    string      `json:"outcome,omitempty"`
+	// Seconds は exit のときにインスタンスにいた秒数
+	Seconds int64 `json:"seconds,omitempty"`
+}
+
+// historyLine はファイルに書く 1 行. 小さくするために短いキーを使い, ワールド名とアクセス制限は読むときに補う
+type historyLine struct {
+	Time     int64       `json:"t"`
+	Profile  int         `json:"p,omitempty"`
+	Kind     HistoryKind `json:"k"`
+	Instance string      `json:"i,omitempty"`
+	Name     string      `json:"n,omitempty"`
+	Cause    RejoinCause `json:"c,omitempty"`
+	Outcome  string      `json:"o,omitempty"`
+	Seconds  int64       `json:"s,omitempty"`
+}
+
+// historyJournal は日ごとのファイルに履歴を追記する. ClientManager では全てのクライアントで共有する
+type historyJournal struct {
+	dir       string
+	retention time.Duration
+	maxBytes  int64
+	lock      *sync.Mutex
+}
+
+func newHistoryJournal(conf *Setting) *historyJournal {
+	return &historyJournal{
+		dir:       conf.HistoryDir,
+		retention: time.Duration(conf.HistoryRetentionDays) * 24 * time.Hour,
+		maxBytes:  int64(conf.HistoryMaxMB) * 1024 * 1024,
+		lock:      &sync.Mutex{},
+	}
+}
+
+func historyFile(dir string, t time.Time) string {
+	return filepath.Join(dir, t.In(time.Local).Format(historyDateFormat)+".jsonl")
+}
+
+// append は r を r の日付のファイルに追記する. history_dir が空のときは何もしない
+func (j *historyJournal) append(r HistoryRecord) error {
+	if j.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(historyLine{
+		Time:     r.Time.Unix(),
+		Profile:  r.Profile,
+		Kind:     r.Kind,
+		Instance: r.Instance,
+		Name:     r.WorldName,
+		Cause:    r.Cause,
+		Outcome:  r.Outcome,
+		Seconds:  r.Seconds,
+	})
+	if err != nil {
+		return err
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(historyFile(j.dir, r.Time), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// openVisit は profile の最後の入退室の記録が出ていない入室のときに, そのインスタンスと入った時刻を返す
+// ツールを立ち上げ直したときに同じ入室を記録し直さないために使う. 新しい 2 日分のファイルだけを見る
+func (j *historyJournal) openVisit(profile int) (Instance, bool) {
+	if j.dir == "" {
+		return Instance{}, false
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	files, err := historyFiles(j.dir)
+	if err != nil {
+		log.Println("failed to read history", err)
+		return Instance{}, false
+	}
+	for n := len(files) - 1; n >= 0 && n >= len(files)-2; n-- {
+		lines, err := readHistoryFile(filepath.Join(j.dir, files[n].Name()))
+		if err != nil {
+			log.Println("failed to read history", err)
+			return Instance{}, false
+		}
+		for i := len(lines) - 1; i >= 0; i-- {
+			l := lines[i]
+			if l.Profile != profile {
+				continue
+			}
+			switch l.Kind {
+			case HistoryEnter:
+				return Instance{ID: l.Instance, Time: time.Unix(l.Time, 0).In(time.Local)}, true
+			case HistoryExit:
+				return Instance{}, false
+			}
+		}
+	}
+	return Instance{}, false
+}
+
+// prune は保存期間を過ぎたファイルを消し, 合計が上限を超えるときは古い日から消す. 今日のファイルは消さない
+func (j *historyJournal) prune(now time.Time) error {
+	if j.dir == "" {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	files, err := historyFiles(j.dir)
+	if err != nil {
+		return err
+	}
+	today := now.In(time.Local).Format(historyDateFormat)
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	for _, f := range files {
+		day := strings.TrimSuffix(f.Name(), ".jsonl")
+		if day == today {
+			break
+		}
+		expired := false
+		if j.retention > 0 {
+			if d, err := time.ParseInLocation(historyDateFormat, day, time.Local); err == nil && now.Sub(d) > j.retention+24*time.Hour {
+				expired = true
+			}
+		}
+		if !expired && (j.maxBytes <= 0 || total <= j.maxBytes) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(j.dir, f.Name())); err != nil {
+			return err
+		}
+		total -= f.Size()
+	}
+	return nil
+}
+
+// historyFiles は履歴のファイルを古い順に返す
+func historyFiles(dir string) ([]os.FileInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []os.FileInfo
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".jsonl") {
+			continue
+		}
+		if _, err := time.Parse(historyDateFormat, strings.TrimSuffix(e.Name(), ".jsonl")); err != nil {
+			continue
+		}
+		files = append(files, e)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
+}
+
+// HistoryQuery narrows down the visit history
+type HistoryQuery struct {
+	From  time.Time
+	To    time.Time
+	World string
+}
+
+// ParseHistoryQuery は YYYY-MM-DD の from, to とワールド ID かワールド名の一部から HistoryQuery を作る. to はその日の終わりまでを含む
+func ParseHistoryQuery(from string, to string, world string) (HistoryQuery, error) {
+	q := HistoryQuery{World: world}
+	if from != "" {
+		t, err := time.ParseInLocation(historyDateFormat, from, time.Local)
+		if err != nil {
+			return q, fmt.Errorf("invalid from: %w", err)
+		}
+		q.From = t
+	}
+	if to != "" {
+		t, err := time.ParseInLocation(historyDateFormat, to, time.Local)
+		if err != nil {
+			return q, fmt.Errorf("invalid to: %w", err)
+		}
+		q.To = t.AddDate(0, 0, 1)
+	}
+	return q, nil
+}
+
+func (q HistoryQuery) match(r HistoryRecord) bool {
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Time.Before(q.To) {
+		return false
+	}
+	if q.World != "" {
+		if strings.HasPrefix(q.World, "wrld_") {
+			return SameInstance(r.Instance, worldOf(q.World))
+		}
+		return strings.Contains(strings.ToLower(r.WorldName), strings.ToLower(q.World))
+	}
+	return true
+}
+
+// ReadHistory は dir の履歴を古い順に読み, q に一致するものを返す
+// ワールド名は同じワールドの記録に補い, ワールド名だけの記録は返さない
+func ReadHistory(dir string, q HistoryQuery) ([]HistoryRecord, error) {
+	files, err := historyFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []HistoryRecord
+	names := map[string]string{}
+	for _, info := range files {
+		day, _ := time.ParseInLocation(historyDateFormat, strings.TrimSuffix(info.Name(), ".jsonl"), time.Local)
+		if !q.From.IsZero() && day.AddDate(0, 0, 1).Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && !day.Before(q.To) {
+			continue
+		}
+		lines, err := readHistoryFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lines {
+			if l.Kind == HistoryWorldName {
+				names[worldOf(l.Instance)] = l.Name
+				continue
+			}
+			r := HistoryRecord{
+				Time:     time.Unix(l.Time, 0).In(time.Local),
+				Profile:  l.Profile,
+				Kind:     l.Kind,
+				Instance: l.Instance,
+				Cause:    l.Cause,
+				Outcome:  l.Outcome,
+				Seconds:  l.Seconds,
+			}
+			if id, err := ParseInstanceID(l.Instance); err == nil {
+				r.AccessType = id.AccessType
+			}
+			records = append(records, r)
+		}
+	}
+
+	var matched []HistoryRecord
+	for _, r := range records {
+		r.WorldName = names[worldOf(r.Instance)]
+		if q.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].Time.Before(matched[j].Time) })
+	return matched, nil
+}
+
+// readHistoryFile は 1 日分のファイルを読む. 書きかけで壊れた行は飛ばす
+func readHistoryFile(path string) ([]historyLine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []historyLine
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var l historyLine
+		if err := json.Unmarshal(s.Bytes(), &l); err != nil {
+			log.Println("skip broken history line in", path)
+			continue
+		}
+		lines = append(lines, l)
+	}
+	return lines, s.Err()
+}
+
+var historyColumns = []string{"time", "profile", "kind", "instance", "world_name", "access_type", "cause", "outcome", "seconds"}
+
+// WriteHistory は records を format (text, json, csv) で w に書き出す
+func WriteHistory(w io.Writer, records []HistoryRecord, format string) error {
+	switch format {
+	case "", "text":
+		for _, r := range records {
+			line := fmt.Sprintf("%s profile %d %s %s", r.Time.Format(TimeFormat), r.Profile, r.Kind, r.Instance)
+			if r.WorldName != "" {
+				line += " (" + r.WorldName + ")"
+			}
+			if r.Cause != "" {
+				line += " cause: " + string(r.Cause)
+			}
+			if r.Outcome != "" {
+				line += " outcome: " + r.Outcome
+			}
+			if r.Seconds > 0 {
+				line += " stayed: " + (time.Duration(r.Seconds) * time.Second).String()
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		if records == nil {
+			records = []HistoryRecord{}
+		}
+		return json.NewEncoder(w).Encode(records)
+	case "csv":
+		c := csv.NewWriter(w)
+		if err := c.Write(historyColumns); err != nil {
+			return err
+		}
+		for _, r := range records {
+			row := []string{
+				r.Time.Format(time.RFC3339), strconv.Itoa(r.Profile), string(r.Kind), r.Instance, r.WorldName,
+				r.AccessType, string(r.Cause), r.Outcome, strconv.FormatInt(r.Seconds, 10),
+			}
+			if err := c.Write(row); err != nil {
+				return err
+			}
+		}
+		c.Flush()
+		return c.Error()
+	}
+	return ErrInvalidHistoryFormat
+}
+
+// recordHistory は r に時刻と profile を入れて履歴に追記する
+func (v *VRCAutoRejoinTool) recordHistory(r HistoryRecord) {
+	if r.Time.IsZero() {
+		r.Time = v.clock.Now()
+	}
+	r.Profile = v.Profile
+	v.session.add(r)
+	if err := v.history.append(r); err != nil {
+		log.Println("failed to write history", err)
+	}
+}
+
+// observeHistory は移動先とワールド名のログを履歴に記録する
+func (v *VRCAutoRejoinTool) observeHistory(line string) {
+	if i, err := v.patterns.Instance(line, v.location); err == nil {
+		v.enterVisit(i)
+		return
+	}
+	if groups, ok := v.patterns.Match(EventRoomName, line); ok && v.visit.ID != "" {
+		r := HistoryRecord{Kind: HistoryWorldName, Instance: worldOf(v.visit.ID), WorldName: strings.TrimSpace(groups["name"])}
+		if lt, err := parseLogTime(line, v.location); err == nil {
+			r.Time = lt
+		}
+		v.recordHistory(r)
+	}
+}
+
+// enterVisit は前のインスタンスを出てインスタンス i に入ったことを記録する
+func (v *VRCAutoRejoinTool) enterVisit(i Instance) {
+	v.exitVisit(i.Time)
+	v.visit = i
+	v.recordHistory(HistoryRecord{Time: i.Time, Kind: HistoryEnter, Instance: i.ID})
+}
+
+// resumeVisit は Run したときに今いるインスタンスを記録する. すでに記録しているインスタンスのときは何もしない
+func (v *VRCAutoRejoinTool) resumeVisit(i Instance) {
+	if i.ID == "" || (v.visit.ID != "" && SameInstance(v.visit.ID, i.ID)) {
+		return
+	}
+	// 止めずにツールを立ち上げ直したときは, 出ていないまま残っている同じインスタンスの入室を引き継ぐ
+	if open, ok := v.history.openVisit(v.Profile); ok && SameInstance(open.ID, i.ID) {
+		v.visit = open
+		return
+	}
+	if i.Time.IsZero() {
+		i.Time = v.clock.Now()
+	}
+	v.enterVisit(i)
+}
+
+// exitVisit は今いるインスタンスを at に出たことを記録する
+func (v *VRCAutoRejoinTool) exitVisit(at time.Time) {
+	if v.visit.ID == "" {
+		return
+	}
+	r := HistoryRecord{Time: at, Kind: HistoryExit, Instance: v.visit.ID}
+	if !v.visit.Time.IsZero() && at.After(v.visit.Time) {
+		r.Seconds = int64(at.Sub(v.visit.Time) / time.Second)
+	}
+	v.recordHistory(r)
+	v.visit = Instance{}
+}
+
+func (v *VRCAutoRejoinTool) History(q HistoryQuery) ([]HistoryRecord, error) {
+	return ReadHistory(v.Config.HistoryDir, q)
+}
@@ -0,0 +1,253 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	historySleep  = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)~nonce(86CB2A7F4E4AC916)"
+	historyFriend = "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~friends(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)"
+)
+
+// recordFixtureHistory は fixture のログを読んだ履歴を dir に書く
+func recordFixtureHistory(t *testing.T, dir string) *VRCAutoRejoinTool {
+	t.Helper()
+	content, err := ioutil.ReadFile(filepath.Join(".test_data", "history.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := newVRCAutoRejoinTool(&Setting{HistoryDir: dir})
+	v.playSound = func(string) {}
+	v.clock = &fakeClock{now: time.Date(2021, 2, 15, 1, 0, 0, 0, time.Local)}
+	for _, line := range strings.Split(strings.ReplaceAll(string(content), "\r", ""), "\n") {
+		if line != "" {
+			v.observe(line)
+		}
+	}
+	v.LatestInstance = v.visit
+	v.decideRejoin(CauseTimeout, Instance{})
+	v.exitVisit(v.clock.Now())
+	return v
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recordFixtureHistory(t, dir)
+
+	all, err := ReadHistory(dir, HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, r := range all {
+		kinds = append(kinds, string(r.Kind))
+	}
+	expect := "enter exit enter exit enter disconnect exit"
+	if strings.Join(kinds, " ") != expect {
+		t.Fatalf("expect %s got %v", expect, kinds)
+	}
+	if all[0].WorldName != "Sleep Room" || all[0].AccessType != "invite" {
+		t.Errorf("expect world name and access type %+v", all[0])
+	}
+	if all[1].Seconds != 2*60*60 {
+		t.Errorf("expect to stay 2 hours got %d seconds", all[1].Seconds)
+	}
+	if all[5].Cause != CauseTimeout || all[5].Outcome != string(ActionRejoin) {
+		t.Errorf("expect timeout rejoin got %+v", all[5])
+	}
+
+	tests := []struct {
+		name   string
+		from   string
+		to     string
+		world  string
+		expect int
+	}{
+		{name: "from", from: "2021-02-15", expect: 4},
+		{name: "to", to: "2021-02-14", expect: 3},
+		{name: "world id", world: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f", expect: 2},
+		{name: "world name", world: "sleep", expect: 5},
+		{name: "world name in a day", from: "2021-02-14", to: "2021-02-14", world: "sleep", expect: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q, err := ParseHistoryQuery(test.from, test.to, test.world)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadHistory(dir, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != test.expect {
+				t.Errorf("expect %d records got %d", test.expect, len(got))
+			}
+		})
+	}
+	if _, err := ParseHistoryQuery("yesterday", "", ""); err == nil {
+		t.Error("expect invalid date")
+	}
+
+	var out bytes.Buffer
+	if err := WriteHistory(&out, all, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(all)+1 || rows[0][0] != "time" || rows[1][3] != historySleep || rows[1][4] != "Sleep Room" {
+		t.Errorf("unexpected csv %v", rows)
+	}
+	if err := WriteHistory(&out, all, "xml"); err != ErrInvalidHistoryFormat {
+		t.Errorf("expect %v got %v", ErrInvalidHistoryFormat, err)
+	}
+}
+
+func TestHistoryResumeVisit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	entered := time.Date(2021, 2, 15, 1, 0, 0, 0, time.Local)
+	start := func(profile int, i Instance) *VRCAutoRejoinTool {
+		v := newVRCAutoRejoinTool(&Setting{HistoryDir: dir})
+		v.Profile = profile
+		v.clock = &fakeClock{now: entered.Add(time.Hour)}
+		v.resumeVisit(i)
+		return v
+	}
+	enters := func() int {
+		all, err := ReadHistory(dir, HistoryQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, r := range all {
+			if r.Kind == HistoryEnter {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Stop せずにツールを立ち上げ直しても同じ入室を記録し直さない
+	start(0, Instance{ID: historySleep, Time: entered})
+	v := start(0, Instance{ID: historySleep, Time: entered})
+	if n := enters(); n != 1 {
+		t.Errorf("expect 1 enter got %d", n)
+	}
+	if !v.visit.Time.Equal(entered) {
+		t.Errorf("open visit must be resumed %v", v.visit)
+	}
+
+	// 他の profile の入室は別に記録する
+	start(1, Instance{ID: historySleep, Time: entered})
+	if n := enters(); n != 2 {
+		t.Errorf("expect 2 enters got %d", n)
+	}
+
+	// 出た後にもう一度始めたときは記録する
+	v.exitVisit(entered.Add(2 * time.Hour))
+	start(0, Instance{ID: historySleep, Time: entered.Add(3 * time.Hour)})
+	if n := enters(); n != 3 {
+		t.Errorf("expect 3 enters got %d", n)
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2021, 2, 15, 12, 0, 0, 0, time.Local)
+	j := newHistoryJournal(&Setting{HistoryDir: dir, HistoryRetentionDays: 7})
+	for _, days := range []int{30, 8, 7, 1, 0} {
+		if err := j.append(HistoryRecord{Time: now.AddDate(0, 0, -days), Kind: HistoryEnter, Instance: historySleep}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 何の記録か分からないファイルは消さない
+	if err := ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("memo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	names := func() string {
+		files, _ := ioutil.ReadDir(dir)
+		var names []string
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		return strings.Join(names, " ")
+	}
+	if got := names(); got != "2021-02-08.jsonl 2021-02-14.jsonl 2021-02-15.jsonl notes.txt" {
+		t.Errorf("unexpected files after retention %s", got)
+	}
+
+	// 上限を超えたときは古い日から消すが今日の分は残す
+	j.maxBytes = 1
+	if err := j.prune(now); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(); got != "2021-02-15.jsonl notes.txt" {
+		t.Errorf("unexpected files after size limit %s", got)
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := recordFixtureHistory(t, dir)
+
+	rec := httptest.NewRecorder()
+	NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?world=wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expect %d got %d", http.StatusOK, rec.Code)
+	}
+	var got []HistoryRecord
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Instance != historyFriend || got[0].AccessType != "friends" {
+		t.Errorf("unexpected history %+v", got)
+	}
+
+	rec = httptest.NewRecorder()
+	NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?format=csv&to=2021-02-14", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/csv" || strings.Count(rec.Body.String(), "\n") != 4 {
+		t.Errorf("unexpected csv %d %s", rec.Code, rec.Body.String())
+	}
+
+	for _, query := range []string{"format=xml", "from=tomorrow"} {
+		rec = httptest.NewRecorder()
+		NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/history?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expect %d got %d", query, http.StatusBadRequest, rec.Code)
+		}
+	}
+}
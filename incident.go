@@ -0,0 +1,333 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrIncidentNotFound is returned when no incident report has the ID
+var ErrIncidentNotFound = errors.New("incident not found")
+
+// incidentIDFormat は incident の ID とファイル名に使う時刻の形式
+const incidentIDFormat = "20060102-150405"
+
+// Incident is a report of a disconnect or rejoin
+type Incident struct {
+	ID          string      `json:"id"`
+	Profile     int         `json:"profile"`
+	Time        time.Time   `json:"time"`
+	Cause       RejoinCause `json:"cause"`
+	Target      string      `json:"target,omitempty"`
+	Destination string      `json:"destination,omitempty"`
+	Rule        string      `json:"rule,omitempty"`
+	Action      RuleAction  `json:"action"`
+	// Outcome は incident の結末. 決まるまでは空
+	Outcome  string         `json:"outcome,omitempty"`
+	Timeline []IncidentStep `json:"timeline"`
+	// Trigger は検出したログの行, Before と After はその前後のログ
+	Trigger string   `json:"trigger,omitempty"`
+	Before  []string `json:"before"`
+	After   []string `json:"after"`
+}
+
+// IncidentStep is an entry of the timeline of an incident
+type IncidentStep struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// redactPatterns は incident_redact のときに伏せるユーザーやグループの ID と nonce
+var redactPatterns = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`usr_[0-9A-Fa-f-]{36}`), "usr_REDACTED"},
+	{regexp.MustCompile(`grp_[0-9A-Fa-f-]{36}`), "grp_REDACTED"},
+	{regexp.MustCompile(`nonce\([^)]*\)`), "nonce(REDACTED)"},
+}
+
+func redact(s string) string {
+	for _, p := range redactPatterns {
+		s = p.re.ReplaceAllString(s, p.with)
+	}
+	return s
+}
+
+// incidentRecorder は直近のログを覚えておき, 切断や rejoin のたびに incident を記録する
+// 結末が決まって検出した後のログが集まるまでは同じ incident に記録を足していく
+type incidentRecorder struct {
+	lock    *sync.Mutex
+	dir     string
+	context int
+	redact  bool
+
+	// recent は直近のエントリより前の context 行, current は直近のエントリの行
+	recent  []string
+	current []string
+	open    *Incident
+}
+
+func newIncidentRecorder(conf *Setting) *incidentRecorder {
+	return &incidentRecorder{lock: &sync.Mutex{}, dir: conf.IncidentDir, context: conf.IncidentContextLines, redact: conf.IncidentRedact}
+}
+
+// entry はログの 1 エントリを覚え, 記録中の incident の後のログに加える
+func (r *incidentRecorder) entry(lines []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.context <= 0 || len(lines) == 0 {
+		return
+	}
+	for _, l := range lines {
+		r.after(l)
+	}
+	r.recent = append(r.recent, r.current...)
+	if len(r.recent) > r.context {
+		r.recent = r.recent[len(r.recent)-r.context:]
+	}
+	r.current = append([]string{}, lines...)
+}
+
+// after は記録中の incident の後のログに l を加え, context 行集まったら保存する
+func (r *incidentRecorder) after(l string) {
+	if r.open == nil || len(r.open.After) >= r.context {
+		return
+	}
+	r.open.After = append(r.open.After, l)
+	if len(r.open.After) == r.context {
+		r.save()
+		if r.open.Outcome != "" {
+			r.open = nil
+		}
+	}
+}
+
+// decided は rejoin するかを決めたことを記録する. 結末が決まっていない incident があればその続きとして記録する
+func (r *incidentRecorder) decided(at time.Time, profile int, cause RejoinCause, target Instance, destination Instance, d RuleDecision) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rule := d.Rule
+	if rule == "" {
+		rule = "default"
+	}
+	message := fmt.Sprintf("%s detected. %s (rule %s)", cause, d.Action, rule)
+	if r.open == nil || r.open.Outcome != "" {
+		r.open = &Incident{
+			ID:          at.Format(incidentIDFormat) + fmt.Sprintf("-p%d", profile),
+			Profile:     profile,
+			Time:        at,
+			Cause:       cause,
+			Target:      target.ID,
+			Destination: destination.ID,
+			Rule:        d.Rule,
+			Action:      d.Action,
+			Before:      []string{},
+			After:       []string{},
+		}
+		// 最後に読んだエントリの先頭の行を検出したログとし, 続きの行は後のログにする
+		r.open.Before = append(r.open.Before, r.recent...)
+		if len(r.current) > 0 {
+			r.open.Trigger = r.current[0]
+			for _, l := range r.current[1:] {
+				r.after(l)
+			}
+		}
+		if r.context <= 0 {
+			r.open.After = nil
+		}
+	}
+	r.open.Timeline = append(r.open.Timeline, IncidentStep{Time: at, Message: message})
+	switch d.Action {
+	case ActionRejoin, ActionDelay, ActionFallback:
+	default:
+		r.open.Outcome = string(d.Action)
+	}
+	r.save()
+}
+
+// step は記録中の incident の経過を記録する
+func (r *incidentRecorder) step(at time.Time, message string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.open == nil || r.open.Outcome != "" {
+		return
+	}
+	r.open.Timeline = append(r.open.Timeline, IncidentStep{Time: at, Message: message})
+	r.save()
+}
+
+// resolve は記録中の incident の結末を記録する
+func (r *incidentRecorder) resolve(at time.Time, outcome string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.open == nil || r.open.Outcome != "" {
+		return
+	}
+	r.open.Timeline = append(r.open.Timeline, IncidentStep{Time: at, Message: outcome})
+	r.open.Outcome = outcome
+	r.save()
+	if len(r.open.After) >= r.context {
+		r.open = nil
+	}
+}
+
+// save は記録中の incident をファイルに書く. incident_dir が空のときは何もしない
+func (r *incidentRecorder) save() {
+	if r.dir == "" || r.open == nil {
+		return
+	}
+	i := *r.open
+	if r.redact {
+		i = redactIncident(i)
+	}
+	b, err := json.MarshalIndent(i, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		log.Println("failed to save incident", err)
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(r.dir, i.ID+".json"), b, 0644); err != nil {
+		log.Println("failed to save incident", err)
+	}
+}
+
+func redactIncident(i Incident) Incident {
+	i.Target = redact(i.Target)
+	i.Destination = redact(i.Destination)
+	i.Trigger = redact(i.Trigger)
+	i.Outcome = redact(i.Outcome)
+	redactLines := func(lines []string) []string {
+		out := make([]string, len(lines))
+		for n, l := range lines {
+			out[n] = redact(l)
+		}
+		return out
+	}
+	i.Before = redactLines(i.Before)
+	i.After = redactLines(i.After)
+	timeline := make([]IncidentStep, len(i.Timeline))
+	for n, s := range i.Timeline {
+		timeline[n] = IncidentStep{Time: s.Time, Message: redact(s.Message)}
+	}
+	i.Timeline = timeline
+	return i
+}
+
+// ListIncidents は dir の incident を新しい順に返す
+func ListIncidents(dir string) ([]Incident, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []Incident{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	incidents := []Incident{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		i, err := readIncident(filepath.Join(dir, f.Name()))
+		if err != nil {
+			log.Println("skip broken incident", f.Name(), err)
+			continue
+		}
+		incidents = append(incidents, i)
+	}
+	sort.SliceStable(incidents, func(a, b int) bool { return incidents[a].Time.After(incidents[b].Time) })
+	return incidents, nil
+}
+
+// ReadIncident は dir から id の incident を読む
+func ReadIncident(dir string, id string) (Incident, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return Incident{}, ErrIncidentNotFound
+	}
+	i, err := readIncident(filepath.Join(dir, id+".json"))
+	if os.IsNotExist(err) {
+		return Incident{}, ErrIncidentNotFound
+	}
+	return i, err
+}
+
+func readIncident(path string) (Incident, error) {
+	var i Incident
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return i, err
+	}
+	err = json.Unmarshal(b, &i)
+	return i, err
+}
+
+// WriteIncidentList は incident の一覧を 1 行ずつ w に書き出す
+func WriteIncidentList(w io.Writer, incidents []Incident) error {
+	for _, i := range incidents {
+		outcome := i.Outcome
+		if outcome == "" {
+			outcome = "in progress"
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", i.ID, i.Cause, i.Action, outcome); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteIncident は incident を読みやすい形で w に書き出す
+func WriteIncident(w io.Writer, i Incident) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "incident %s (profile %d)\n", i.ID, i.Profile)
+	fmt.Fprintf(&b, "time: %s\ncause: %s\ntarget: %s\n", i.Time.Format(TimeFormat), i.Cause, i.Target)
+	if i.Destination != "" {
+		fmt.Fprintf(&b, "destination: %s\n", i.Destination)
+	}
+	rule := i.Rule
+	if rule == "" {
+		rule = "(default)"
+	}
+	fmt.Fprintf(&b, "decision: %s -> %s\n", rule, i.Action)
+	outcome := i.Outcome
+	if outcome == "" {
+		outcome = "in progress"
+	}
+	fmt.Fprintf(&b, "outcome: %s\n\ntimeline:\n", outcome)
+	for _, s := range i.Timeline {
+		fmt.Fprintf(&b, "  %s %s\n", s.Time.Format(TimeFormat), s.Message)
+	}
+	b.WriteString("\nlog:\n")
+	for _, l := range i.Before {
+		fmt.Fprintf(&b, "  %s\n", l)
+	}
+	if i.Trigger != "" {
+		fmt.Fprintf(&b, "> %s\n", i.Trigger)
+	}
+	for _, l := range i.After {
+		fmt.Fprintf(&b, "  %s\n", l)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (v *VRCAutoRejoinTool) Incidents() ([]Incident, error) {
+	return ListIncidents(v.Config.IncidentDir)
+}
+
+func (v *VRCAutoRejoinTool) Incident(id string) (Incident, error) {
+	return ReadIncident(v.Config.IncidentDir, id)
+}
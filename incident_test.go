@@ -0,0 +1,143 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const incidentTarget = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)~nonce(86CB2A7F4E4AC916)"
+
+// recordIncident は timeout で rejoin して入り直すまでを記録する
+func recordIncident(t *testing.T, dir string, redact bool) *VRCAutoRejoinTool {
+	t.Helper()
+	v := newVRCAutoRejoinTool(&Setting{IncidentDir: dir, IncidentContextLines: 3, IncidentRedact: redact})
+	v.playSound = func(string) {}
+	v.clock = &fakeClock{now: time.Date(2021, 2, 14, 4, 0, 0, 0, time.Local)}
+	v.LatestInstance = Instance{ID: incidentTarget}
+
+	for n := 1; n <= 4; n++ {
+		v.incidents.entry([]string{fmt.Sprintf("2021.02.14 03:59:5%d Log        -  line %d", n, n)})
+	}
+	v.incidents.entry([]string{"2021.02.14 04:00:00 Error      -  [Behaviour] " + Timeout + " " + incidentTarget, "  at VRC.Core.API"})
+	if !v.decideRejoin(CauseTimeout, Instance{}) {
+		t.Fatal("expect to rejoin")
+	}
+	v.incidents.step(v.clock.Now(), "rejoin 1 launched")
+	v.incidents.entry([]string{"2021.02.14 04:00:01 Log        -  after 1"})
+	v.verifyRejoin(Instance{ID: incidentTarget})
+	for n := 2; n <= 4; n++ {
+		v.incidents.entry([]string{fmt.Sprintf("2021.02.14 04:00:0%d Log        -  after %d", n, n)})
+	}
+	return v
+}
+
+func TestIncident(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incidents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := recordIncident(t, dir, false)
+
+	list, err := ListIncidents(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expect 1 incident got %d", len(list))
+	}
+	i := list[0]
+	if i.ID != "20210214-040000-p0" || i.Cause != CauseTimeout || i.Action != ActionRejoin || i.Outcome != "joined "+incidentTarget {
+		t.Errorf("unexpected incident %+v", i)
+	}
+	if !strings.HasPrefix(i.Trigger, "2021.02.14 04:00:00") || len(i.Before) != 3 || i.Before[0] != "2021.02.14 03:59:52 Log        -  line 2" || i.Before[2] != "2021.02.14 03:59:54 Log        -  line 4" {
+		t.Errorf("unexpected log before trigger %q %q", i.Before, i.Trigger)
+	}
+	if strings.Join(i.After, ",") != "  at VRC.Core.API,2021.02.14 04:00:01 Log        -  after 1,2021.02.14 04:00:02 Log        -  after 2" {
+		t.Errorf("unexpected log after trigger %q", i.After)
+	}
+	if len(i.Timeline) != 3 {
+		t.Errorf("expect detection, launch and outcome got %+v", i.Timeline)
+	}
+
+	// 結末が決まった後の切断は新しい incident にする
+	v.clock.Sleep(time.Minute)
+	v.incidents.entry([]string{"2021.02.14 04:01:00 Error      -  [Behaviour] " + Timeout})
+	v.Config.Rules = []Rule{{Name: "night", Action: ActionIgnore}}
+	v.rules, _ = compileRules(v.Config)
+	v.decideRejoin(CauseTimeout, Instance{})
+	if list, _ = ListIncidents(dir); len(list) != 2 || list[0].Rule != "night" || list[0].Outcome != string(ActionIgnore) {
+		t.Errorf("expect the ignored incident first %+v", list)
+	}
+
+	var out bytes.Buffer
+	if err := WriteIncident(&out, i); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "> 2021.02.14 04:00:00") || !strings.Contains(out.String(), "decision: (default) -> rejoin") {
+		t.Errorf("unexpected report\n%s", out.String())
+	}
+	if _, err := ReadIncident(dir, "../state"); err != ErrIncidentNotFound {
+		t.Errorf("expect %v got %v", ErrIncidentNotFound, err)
+	}
+}
+
+func TestIncidentRedact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incidents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	recordIncident(t, dir, true)
+
+	b, err := ioutil.ReadFile(dir + "/20210214-040000-p0.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "usr_d97adcdc") || strings.Contains(string(b), "86CB2A7F4E4AC916") {
+		t.Errorf("private IDs must be redacted\n%s", b)
+	}
+	if !strings.Contains(string(b), "private(usr_REDACTED)~region(jp)~nonce(REDACTED)") {
+		t.Errorf("expect redacted target\n%s", b)
+	}
+}
+
+func TestAPIIncidents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "incidents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	v := recordIncident(t, dir, false)
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/api/incidents", http.StatusOK},
+		{"/api/incidents/20210214-040000-p0", http.StatusOK},
+		{"/api/incidents/20210214-050000-p0", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+		if rec.Code != test.code {
+			t.Errorf("%s: expect %d got %d", test.path, test.code, rec.Code)
+			continue
+		}
+		if test.path == "/api/incidents/20210214-040000-p0" {
+			var i Incident
+			if err := json.NewDecoder(rec.Body).Decode(&i); err != nil || i.Cause != CauseTimeout {
+				t.Errorf("unexpected incident %+v %v", i, err)
+			}
+		}
+	}
+}
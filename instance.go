@@ -1,11 +1,15 @@
 package vrcarjt
 
 import (
-	"bytes"
 	"errors"
-	"log"
+	"fmt"
+	"math/rand"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Instance struct {
@@ -14,24 +18,181 @@ type Instance struct {
 }
 
 var worldRegexp = regexp.MustCompile(`wrld_.+$`)
+
+var (
+	// ErrShortLogLine is returned when a log line is too short to have a timestamp
+	ErrShortLogLine = errors.New("log line is too short")
+	// ErrInvalidLogEncoding is returned when a log line is not valid UTF-8
+	ErrInvalidLogEncoding = errors.New("log line is not valid utf-8")
+	// ErrMalformedLogLine is returned when a log line has broken content such as control characters
+	ErrMalformedLogLine = errors.New("log line is malformed")
+	// ErrWorldLogNotFound is returned when a log line does not have a world ID
+	ErrWorldLogNotFound = errors.New("world log not found")
+)
+
+// NewInstanceByLog はログの時刻を time.Local として Instance を返す
 func NewInstanceByLog(logs string) (Instance, error) {
-	lt, err := parseLogTime(logs)
+	return newInstanceByLog(logs, worldRegexp.FindString(logs), time.Local)
+}
+
+// newInstanceByLog は logs から取り出した instance ID の group を検証して Instance を返す
+func newInstanceByLog(logs string, group string, loc *time.Location) (Instance, error) {
+	if !utf8.ValidString(logs) {
+		return Instance{}, ErrInvalidLogEncoding
+	}
+	lt, err := parseLogTime(logs, loc)
 	if err != nil {
-		log.Println(err)
 		return Instance{}, err
 	}
-	group := worldRegexp.FindSubmatch([]byte(logs))
-	if len(group) > 0 {
-		return Instance{ID: string(bytes.Trim(group[0], "\x00")), Time: lt}, nil
+	if group == "" {
+		return Instance{}, ErrWorldLogNotFound
+	}
+
+	// 書き込み途中のログには \x00 が混ざることがある
+	id := strings.TrimRight(strings.Trim(group, "\x00"), "\x00 \t\r")
+	for _, r := range id {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return Instance{}, fmt.Errorf("%w: %q", ErrMalformedLogLine, id)
+		}
 	}
 
-	return Instance{}, errors.New("world log not found")
+	return Instance{ID: id, Time: lt}, nil
 }
 
-func parseLogTime(log string) (time.Time, error) {
-	logTime, err := time.ParseInLocation(TimeFormat, log[:19], time.Local)
+func parseLogTime(log string, loc *time.Location) (time.Time, error) {
+	if len(log) < len(TimeFormat) {
+		return time.Time{}, ErrShortLogLine
+	}
+	logTime, err := time.ParseInLocation(TimeFormat, log[:len(TimeFormat)], loc)
 	if err != nil {
 		return logTime, err
 	}
 	return logTime, nil
 }
+
+// InstanceID is a parsed VRChat instance ID such as
+// wrld_xxx:12345~private(usr_xxx)~canRequestInvite~region(jp)~nonce(xxx)
+type InstanceID struct {
+	WorldID string
+	Name    string
+	// AccessType は public, friends+, friends, invite+, invite, group のいずれか
+	AccessType string
+	Owner      string
+	Region     string
+	Nonce      string
+	// Tags は nonce 以外の ~ で区切られたタグ. 元の順番のまま保持する
+	Tags []string
+}
+
+var instanceTagRegexp = regexp.MustCompile(`^([A-Za-z+]+)(?:\(([^)]*)\))?$`)
+
+// ParseInstanceID は instance ID を分解する
+func ParseInstanceID(id string) (InstanceID, error) {
+	parts := strings.Split(id, "~")
+	world := strings.SplitN(parts[0], ":", 2)
+	if !strings.HasPrefix(world[0], "wrld_") {
+		return InstanceID{}, fmt.Errorf("invalid instance id %q", id)
+	}
+
+	i := InstanceID{WorldID: world[0], AccessType: "public"}
+	if len(world) == 2 {
+		i.Name = world[1]
+	}
+
+	private := false
+	canRequestInvite := false
+	for _, tag := range parts[1:] {
+		m := instanceTagRegexp.FindStringSubmatch(tag)
+		if m == nil {
+			return InstanceID{}, fmt.Errorf("invalid instance tag %q in %q", tag, id)
+		}
+		switch m[1] {
+		case "nonce":
+			i.Nonce = m[2]
+			continue
+		case "region":
+			i.Region = m[2]
+		case "hidden":
+			i.AccessType = "friends+"
+			i.Owner = m[2]
+		case "friends":
+			i.AccessType = "friends"
+			i.Owner = m[2]
+		case "private":
+			private = true
+			i.Owner = m[2]
+		case "canRequestInvite":
+			canRequestInvite = true
+		case "group":
+			i.AccessType = "group"
+			i.Owner = m[2]
+		}
+		i.Tags = append(i.Tags, tag)
+	}
+	if private {
+		i.AccessType = "invite"
+		if canRequestInvite {
+			i.AccessType = "invite+"
+		}
+	}
+
+	return i, nil
+}
+
+// String は instance ID に組み立て直す
+func (i InstanceID) String() string {
+	s := i.WorldID
+	if i.Name != "" {
+		s += ":" + i.Name
+	}
+	for _, tag := range i.Tags {
+		s += "~" + tag
+	}
+	if i.Nonce != "" {
+		s += "~nonce(" + i.Nonce + ")"
+	}
+	return s
+}
+
+// NewInstance は同じワールドに同じアクセス制限とリージョンで別のインスタンスを作る instance ID を返す
+// nonce は元のインスタンスにしか使えないため外す. invite, friends, friends+ のインスタンスは自分のものしか作れないため
+// owner (自分のユーザー ID) を持ち主にする. owner がわからないときとグループのインスタンスは作れないので false を返す
+func (i InstanceID) NewInstance(r *rand.Rand, owner string) (InstanceID, bool) {
+	n := i
+	n.Name = strconv.Itoa(10000 + r.Intn(90000))
+	n.Nonce = ""
+	n.Tags = make([]string, 0, len(i.Tags))
+	for _, tag := range i.Tags {
+		m := instanceTagRegexp.FindStringSubmatch(tag)
+		switch m[1] {
+		case "group", "groupAccessType":
+			return InstanceID{}, false
+		case "private", "friends", "hidden":
+			if owner == "" {
+				return InstanceID{}, false
+			}
+			tag = m[1] + "(" + owner + ")"
+			n.Owner = owner
+		}
+		n.Tags = append(n.Tags, tag)
+	}
+	return n, true
+}
+
+// SameInstance は a と b が nonce を除いて同じインスタンスかを返す
+// b にインスタンス名がないときはワールドが同じであれば同じとみなす
+func SameInstance(a string, b string) bool {
+	ai, err := ParseInstanceID(a)
+	if err != nil {
+		return a == b
+	}
+	bi, err := ParseInstanceID(b)
+	if err != nil {
+		return a == b
+	}
+	if bi.Name == "" {
+		return ai.WorldID == bi.WorldID
+	}
+	ai.Nonce, bi.Nonce = "", ""
+	return ai.String() == bi.String()
+}
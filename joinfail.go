@@ -0,0 +1,84 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// joinFailureEvents は入れなかったときのログと理由
+var joinFailureEvents = []struct {
+	event   LogEvent
+	cause   RejoinCause
+	message string
+}{
+	{EventInstanceFull, CauseInstanceFull, "instance is full"},
+	{EventInstanceClosed, CauseInstanceClosed, "instance is closed"},
+	{EventWorldLoadFailed, CauseWorldLoadFailed, "failed to load world"},
+}
+
+// joinFailureOf は line が入れなかったときのログのときに理由を返す
+func (c *moveClassifier) joinFailureOf(line string) (RejoinCause, bool) {
+	for _, f := range joinFailureEvents {
+		if _, ok := c.patterns.Match(f.event, line); ok {
+			return f.cause, true
+		}
+	}
+	return "", false
+}
+
+// joinFailureBefore は at の直前に入れなかったときのログがあればその理由を返す
+func (c *moveClassifier) joinFailureBefore(at time.Time) (RejoinCause, bool) {
+	if c.joinFailed.IsZero() || c.joinFailed.After(at) || at.Sub(c.joinFailed) > moveContextWindow {
+		return "", false
+	}
+	return c.joinFailure, true
+}
+
+// observeJoinFailure は入れなかったときのログを理由付きのイベントにする
+func (v *VRCAutoRejoinTool) observeJoinFailure(line string) {
+	cause, ok := v.moves.joinFailureOf(line)
+	if !ok {
+		return
+	}
+	target, _ := v.rejoinTarget()
+	for _, f := range joinFailureEvents {
+		if f.cause == cause {
+			v.emit(Event{
+				Time:     v.clock.Now(),
+				Profile:  v.Profile,
+				Type:     EventJoinFailed,
+				Instance: target.ID,
+				Message:  fmt.Sprintf("could not join %s: %s", target.ID, f.message),
+				Reason:   string(cause),
+			})
+		}
+	}
+}
+
+// joinFailureCause は rejoin したのに i に入ったときの理由を返す. 入れなかったログがないときは CauseVerify を返す
+func (v *VRCAutoRejoinTool) joinFailureCause(i Instance) RejoinCause {
+	if cause, ok := v.moves.joinFailureBefore(i.Time); ok {
+		return cause
+	}
+	return CauseVerify
+}
+
+// retryJoin は入れなかった理由 cause から fallback に進まずに同じインスタンスに入り直すかを返す
+// 満員のときは空くのを待って入り直す. ワールドの読み込みに失敗したときは 1 回だけ入り直す. 閉じたインスタンスには入り直さない
+func (v *VRCAutoRejoinTool) retryJoin(cause RejoinCause) bool {
+	retry := false
+	switch cause {
+	case CauseInstanceFull:
+		retry = true
+	case CauseWorldLoadFailed:
+		retry = v.lastJoinFailure != CauseWorldLoadFailed
+	}
+	if !retry {
+		v.lastJoinFailure = ""
+		return false
+	}
+	v.lastJoinFailure = cause
+	log.Println("retry joining the same instance after", cause)
+	return true
+}
@@ -0,0 +1,87 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinFailure(t *testing.T) {
+	const original = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)"
+	const fallbackWorld = "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f"
+
+	tests := []struct {
+		fixture string
+		reason  RejoinCause
+		// targets は同じ失敗を繰り返したときに次に入ろうとするインスタンス
+		targets []string
+		waited  time.Duration
+	}{
+		{fixture: "join_full.txt", reason: CauseInstanceFull, targets: []string{original, original}, waited: 5 * time.Minute},
+		{fixture: "join_closed.txt", reason: CauseInstanceClosed, targets: []string{fallbackWorld}},
+		{fixture: "join_load_failed.txt", reason: CauseWorldLoadFailed, targets: []string{original, fallbackWorld}},
+		{fixture: "move_home.txt", reason: CauseVerify, targets: []string{fallbackWorld}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			content, err := ioutil.ReadFile(filepath.Join(".test_data", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.ReplaceAll(string(content), "\r", ""), "\n")
+
+			// join_full_retry_minutes は既定値を使う. 状態や履歴はリポジトリに書き出さない
+			conf := *defaultSetting
+			conf.StateFile, conf.HistoryDir, conf.IncidentDir, conf.SummaryDir = "", "", "", ""
+			conf.FallbackWorlds = []string{fallbackWorld}
+			v := newVRCAutoRejoinTool(&conf)
+			v.playSound = func(string) {}
+			clock := &fakeClock{now: time.Date(2021, 2, 14, 4, 0, 0, 0, time.Local)}
+			v.clock = clock
+			v.LatestInstance = Instance{ID: original}
+			v.running = true
+
+			for n, expect := range test.targets {
+				start := clock.now
+				v.verifying = true
+				for _, line := range lines {
+					if line == "" || strings.Contains(line, "Destination set: "+original) {
+						continue
+					}
+					if i, err := v.patterns.Instance(line, v.location); err == nil {
+						if !v.checkRejoined(line, i) {
+							t.Fatal("expect to rejoin again")
+						}
+						continue
+					}
+					v.detectRejoin(start, line)
+				}
+				if target, _ := v.rejoinTarget(); target.ID != expect {
+					t.Errorf("attempt %d: target expect %q got %q", n+1, expect, target.ID)
+				}
+				if waited := clock.now.Sub(start); waited != test.waited {
+					t.Errorf("attempt %d: expect to wait %s got %s", n+1, test.waited, waited)
+				}
+			}
+
+			var reasons []string
+			for _, e := range v.Events() {
+				if e.Type == EventJoinFailed {
+					reasons = append(reasons, e.Reason)
+				}
+			}
+			if test.reason == CauseVerify {
+				if len(reasons) != 0 {
+					t.Errorf("expect no join failure events got %v", reasons)
+				}
+				return
+			}
+			if len(reasons) != len(test.targets) || reasons[0] != string(test.reason) {
+				t.Errorf("expect %d %s events got %v", len(test.targets), test.reason, reasons)
+			}
+		})
+	}
+}
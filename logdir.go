@@ -0,0 +1,106 @@
+package vrcarjt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// VRChat の Steam の AppID
+const vrchatAppID = "438100"
+
+// ErrLogDirNotFound is an error that is returned when the VRChat log directory could not be found
+var ErrLogDirNotFound = errors.New("vrchat log directory not found")
+
+// libraryfolders.vdf の "path" "..." と古い形式の "1" "..." に一致する
+var steamLibraryPathRegexp = regexp.MustCompile(`(?m)^\s*"(?:path|\d+)"\s+"([^"]+)"`)
+
+// findLogDir は VRChat の output_log があるディレクトリを探す
+// override が指定されているときはそれを優先する
+func findLogDir(goos string, home string, override string) (string, error) {
+	if override != "" {
+		if isDir(override) {
+			return override, nil
+		}
+		return "", ErrLogDirNotFound
+	}
+
+	for _, dir := range logDirCandidates(goos, home) {
+		if isDir(dir) {
+			return dir, nil
+		}
+	}
+	return "", ErrLogDirNotFound
+}
+
+func logDirCandidates(goos string, home string) []string {
+	if goos == "windows" {
+		return []string{filepath.Join(home, "AppData", "LocalLow", "VRChat", "VRChat")}
+	}
+
+	// Linux では Steam Proton の prefix の中に Windows と同じ構成で置かれる
+	var dirs []string
+	for _, library := range steamLibraries(home) {
+		dirs = append(dirs, filepath.Join(library, "steamapps", "compatdata", vrchatAppID, "pfx",
+			"drive_c", "users", "steamuser", "AppData", "LocalLow", "VRChat", "VRChat"))
+	}
+	return dirs
+}
+
+// steamLibraries は Steam のインストール先と libraryfolders.vdf に登録されたライブラリを返す
+func steamLibraries(home string) []string {
+	roots := []string{
+		filepath.Join(home, ".steam", "steam"),
+		filepath.Join(home, ".steam", "root"),
+		filepath.Join(home, ".local", "share", "Steam"),
+		filepath.Join(home, ".var", "app", "com.valvesoftware.Steam", ".local", "share", "Steam"),
+	}
+
+	seen := map[string]bool{}
+	var libraries []string
+	add := func(dir string) {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = real
+		}
+		if seen[dir] {
+			return
+		}
+		seen[dir] = true
+		libraries = append(libraries, dir)
+	}
+
+	for _, root := range roots {
+		if !isDir(root) {
+			continue
+		}
+		add(root)
+
+		vdf, err := ioutil.ReadFile(filepath.Join(root, "steamapps", "libraryfolders.vdf"))
+		if err != nil {
+			continue
+		}
+		for _, m := range steamLibraryPathRegexp.FindAllStringSubmatch(string(vdf), -1) {
+			dir := strings.ReplaceAll(m[1], `\\`, `\`)
+			if isDir(dir) {
+				add(dir)
+			}
+		}
+	}
+	return libraries
+}
+
+func isDir(path string) bool {
+	stat, err := os.Stat(path)
+	return err == nil && stat.IsDir()
+}
+
+// steamLaunch は Proton の VRChat を立ち上げ直すために Steam 経由で起動する Exec にする
+func steamLaunch(steam string, e Exec) Exec {
+	return Exec{
+		ExePath: steam,
+		Args:    append([]string{"-applaunch", vrchatAppID}, e.Args...),
+	}
+}
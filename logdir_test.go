@@ -0,0 +1,149 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindLogDir(t *testing.T) {
+	home, err := ioutil.TempDir("", "vrcarjt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	logDir := func(library string) string {
+		return filepath.Join(library, "steamapps", "compatdata", "438100", "pfx",
+			"drive_c", "users", "steamuser", "AppData", "LocalLow", "VRChat", "VRChat")
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		if _, err := findLogDir("linux", home, ""); err != ErrLogDirNotFound {
+			t.Errorf("expect %v got %v", ErrLogDirNotFound, err)
+		}
+	})
+
+	t.Run("windows", func(t *testing.T) {
+		expect := filepath.Join(home, "AppData", "LocalLow", "VRChat", "VRChat")
+		if err := os.MkdirAll(expect, 0755); err != nil {
+			t.Fatal(err)
+		}
+		got, err := findLogDir("windows", home, "")
+		if err != nil || got != expect {
+			t.Errorf("expect %v got %v %v", expect, got, err)
+		}
+	})
+
+	t.Run("proton in additional library", func(t *testing.T) {
+		root := filepath.Join(home, ".local", "share", "Steam")
+		library := filepath.Join(home, "SteamLibrary")
+		if err := os.MkdirAll(filepath.Join(root, "steamapps"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		vdf := `"libraryfolders"
+{
+	"0"
+	{
+		"path"		"` + root + `"
+	}
+	"1"
+	{
+		"path"		"` + library + `"
+	}
+}`
+		if err := ioutil.WriteFile(filepath.Join(root, "steamapps", "libraryfolders.vdf"), []byte(vdf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(logDir(library), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := findLogDir("linux", home, "")
+		if err != nil || got != logDir(library) {
+			t.Errorf("expect %v got %v %v", logDir(library), got, err)
+		}
+	})
+
+	t.Run("proton in additional library of old libraryfolders.vdf", func(t *testing.T) {
+		root := filepath.Join(home, ".steam", "steam")
+		library := filepath.Join(home, "OldSteamLibrary")
+		if err := os.MkdirAll(filepath.Join(root, "steamapps"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		vdf := `"LibraryFolders"
+{
+	"TimeNextStatsReport"		"1602000000"
+	"ContentStatsID"		"1234567890"
+	"1"		"` + library + `"
+}`
+		if err := ioutil.WriteFile(filepath.Join(root, "steamapps", "libraryfolders.vdf"), []byte(vdf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(logDir(library), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		libraries := steamLibraries(home)
+		found := false
+		for _, l := range libraries {
+			found = found || l == library
+		}
+		if !found {
+			t.Errorf("expect %v in %v", library, libraries)
+		}
+	})
+
+	t.Run("override", func(t *testing.T) {
+		got, err := findLogDir("linux", home, home)
+		if err != nil || got != home {
+			t.Errorf("expect %v got %v %v", home, got, err)
+		}
+		if _, err := findLogDir("linux", home, filepath.Join(home, "missing")); err != ErrLogDirNotFound {
+			t.Errorf("expect %v got %v", ErrLogDirNotFound, err)
+		}
+	})
+}
+
+func TestSteamLaunch(t *testing.T) {
+	e := prepareExecArgs(`Z:\home\user\.steam\steam\steamapps\common\VRChat\VRChat.exe --no-vr`, Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d"})
+	expect := Exec{
+		ExePath: "steam",
+		Args:    []string{"-applaunch", "438100", "--no-vr", "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+	}
+	if got := steamLaunch("steam", e); !reflect.DeepEqual(got, expect) {
+		t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+	}
+}
+
+type fakeCmdline []string
+
+func (f fakeCmdline) Cmdline() (string, error) {
+	return strings.Join(f, " "), nil
+}
+
+func (f fakeCmdline) CmdlineSlice() ([]string, error) {
+	return f, nil
+}
+
+func TestSteamLaunchKeepsArgsWithSpaces(t *testing.T) {
+	argv := fakeCmdline{`Z:\home\user\Steam Library\steamapps\common\VRChat\VRChat.exe`, "--no-vr", "-logFile", `Z:\home\user\vrchat logs\output.txt`, "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345&ref=my world"}
+	args, err := processCommandLine("linux", argv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := prepareExecArgs(args, Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"})
+	if e.ExePath != argv[0] {
+		t.Errorf("exe path must keep spaces got %q", e.ExePath)
+	}
+	expect := Exec{
+		ExePath: "steam",
+		Args:    []string{"-applaunch", "438100", "--no-vr", "-logFile", `Z:\home\user\vrchat logs\output.txt`, "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"},
+	}
+	if got := steamLaunch("steam", e); !reflect.DeepEqual(got, expect) {
+		t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+	}
+}
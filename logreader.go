@@ -0,0 +1,340 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// logEntry はログの 1 エントリ. 例外のスタックトレースなどの続きの行も含む
+type logEntry struct {
+	Lines []string
+}
+
+// Header はエントリの時刻から始まる最初の行
+func (e logEntry) Header() string {
+	if len(e.Lines) == 0 {
+		return ""
+	}
+	return e.Lines[0]
+}
+
+func (e logEntry) String() string {
+	return strings.Join(e.Lines, "\n")
+}
+
+var logHeaderRegexp = regexp.MustCompile(`^\d{4}\.\d{2}\.\d{2} \d{2}:\d{2}:\d{2} `)
+
+// logEntryReader は書き込まれたログを行の途中で受け取っても, 続きの行をまとめた完全なエントリにする
+// 改行まで書き込まれていない最後の行は続きが書き込まれるまで保持し, 同じエントリが続いたときは 1 つにまとめる
+type logEntryReader struct {
+	partial []byte
+	current []string
+	last    string
+}
+
+// feed は追記されたログを受け取り, 完成したエントリを返す
+func (r *logEntryReader) feed(p []byte) []logEntry {
+	var entries []logEntry
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(r.partial[:i]), "\r")
+		r.partial = r.partial[i+1:]
+		entries = append(entries, r.line(line)...)
+	}
+	// 次の feed で前にずらせるように読み終えた領域を捨てる
+	r.partial = append([]byte{}, r.partial...)
+	return entries
+}
+
+func (r *logEntryReader) line(line string) []logEntry {
+	switch {
+	case strings.TrimSpace(line) == "":
+		// VRChat はエントリの後に空行を書く
+		return r.flushEntry()
+	case logHeaderRegexp.MatchString(line):
+		entries := r.flushEntry()
+		r.current = []string{line}
+		return entries
+	default:
+		r.current = append(r.current, line)
+		return nil
+	}
+}
+
+// flush は書き込みが止まったときに保持しているエントリを返す
+// 改行まで書き込まれていない行は書き込み途中の可能性があるため返さない
+func (r *logEntryReader) flush() []logEntry {
+	return r.flushEntry()
+}
+
+func (r *logEntryReader) flushEntry() []logEntry {
+	if len(r.current) == 0 {
+		return nil
+	}
+	e := logEntry{Lines: r.current}
+	r.current = nil
+
+	s := e.String()
+	if s == r.last {
+		return nil
+	}
+	r.last = s
+	return []logEntry{e}
+}
+
+const (
+	logPollInterval = 250 * time.Millisecond
+	// logFlushAfter の間追記がなければ保持しているエントリを完成したものとして扱う
+	logFlushAfter = time.Second
+	// 通知で読んでいる間も logSafetyPollInterval ごとに読み, 通知が届いていない追記が
+	// logMissedNotifyLimit 回続いたらポーリングに切り替える
+	logSafetyPollInterval = 5 * time.Second
+	logMissedNotifyLimit  = 2
+)
+
+// logFollower はログファイルへの追記を読み続けてエントリにする
+// ファイルシステムの変更通知で読み, ネットワークドライブや Proton の prefix などで通知が届かないときはポーリングで読む
+type logFollower struct {
+	path    string
+	offset  int64
+	reader  *logEntryReader
+	entries chan logEntry
+	stop    chan struct{}
+	once    *sync.Once
+
+	watch          func(path string) (<-chan struct{}, func(), error)
+	pollInterval   time.Duration
+	safetyInterval time.Duration
+}
+
+// followLog は path を offset から読み始める
+func followLog(path string, offset int64) *logFollower {
+	f := newLogFollower(path, offset, watchLogFile)
+	go f.run()
+	return f
+}
+
+func newLogFollower(path string, offset int64, watch func(path string) (<-chan struct{}, func(), error)) *logFollower {
+	return &logFollower{
+		path:           path,
+		offset:         offset,
+		reader:         &logEntryReader{},
+		entries:        make(chan logEntry),
+		stop:           make(chan struct{}),
+		once:           &sync.Once{},
+		watch:          watch,
+		pollInterval:   logPollInterval,
+		safetyInterval: logSafetyPollInterval,
+	}
+}
+
+// watchLogFile は path のあるディレクトリを監視し, path が書き込まれたときに通知する
+// ファイルが作り直されても追えるようにファイルではなくディレクトリを監視する
+func watchLogFile(path string) (<-chan struct{}, func(), error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		_ = w.Close()
+		return nil, nil, err
+	}
+
+	notify := make(chan struct{}, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(notify)
+		for {
+			select {
+			case <-done:
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != filepath.Clean(path) {
+					continue
+				}
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Println(err)
+			}
+		}
+	}()
+
+	return notify, func() {
+		close(done)
+		_ = w.Close()
+	}, nil
+}
+
+func (f *logFollower) Entries() <-chan logEntry {
+	return f.entries
+}
+
+func (f *logFollower) Stop() {
+	f.once.Do(func() {
+		close(f.stop)
+	})
+}
+
+func (f *logFollower) run() {
+	defer close(f.entries)
+
+	var notify <-chan struct{}
+	closeWatch := func() {}
+	if f.watch != nil {
+		var err error
+		notify, closeWatch, err = f.watch(f.path)
+		if err != nil {
+			log.Println("log notification is not available. fallback to polling:", err)
+			notify, closeWatch = nil, func() {}
+		}
+	}
+	defer func() {
+		closeWatch()
+	}()
+
+	interval := f.pollInterval
+	if notify != nil {
+		interval = logFlushAfter
+		if f.safetyInterval < interval {
+			interval = f.safetyInterval
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastRead := time.Now()
+	lastSafety := time.Now()
+	notified := false
+	missed := 0
+	read := func() bool {
+		// 読めないときは次に読むときに読み直す
+		n, _ := f.read()
+		if n > 0 {
+			lastRead = time.Now()
+		}
+		return n > 0
+	}
+	read()
+
+	for {
+		select {
+		case <-f.stop:
+			return
+		case _, ok := <-notify:
+			if !ok {
+				log.Println("log notification stopped. fallback to polling")
+				notify = nil
+				ticker.Reset(f.pollInterval)
+				continue
+			}
+			notified = true
+			read()
+		case <-ticker.C:
+			if notify == nil {
+				read()
+			} else if time.Since(lastSafety) >= f.safetyInterval {
+				missed = countMissedNotify(missed, read(), notified)
+				if missed >= logMissedNotifyLimit {
+					log.Println("log notification is not delivered. fallback to polling")
+					closeWatch()
+					closeWatch = func() {}
+					notify = nil
+					ticker.Reset(f.pollInterval)
+				}
+				notified = false
+				lastSafety = time.Now()
+			}
+			if time.Since(lastRead) >= logFlushAfter {
+				if !f.emit(f.reader.flush()) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// countMissedNotify は通知が届かないまま追記を読んだ安全のための読み込みが続いた回数を返す
+// 通知が届いていればそこで数え直す
+func countMissedNotify(missed int, read bool, notified bool) int {
+	if notified {
+		return 0
+	}
+	if read {
+		return missed + 1
+	}
+	return missed
+}
+
+// read は前回読んだところから追記された分を読む
+func (f *logFollower) read() (int, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// 作り直されたり切り詰められたときは最初から読む
+	if stat.Size() < f.offset {
+		f.offset = 0
+		f.reader = &logEntryReader{}
+	}
+	if _, err := file.Seek(f.offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	total := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			total += n
+			f.offset += int64(n)
+			if !f.emit(f.reader.feed(buf[:n])) {
+				return total, nil
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (f *logFollower) emit(entries []logEntry) bool {
+	for _, e := range entries {
+		select {
+		case f.entries <- e:
+		case <-f.stop:
+			return false
+		}
+	}
+	return true
+}
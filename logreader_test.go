@@ -0,0 +1,251 @@
+package vrcarjt
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLogEntryReader(t *testing.T) {
+	t.Run("multi-line entry", func(t *testing.T) {
+		r := &logEntryReader{}
+		got := r.feed([]byte("2021.02.14 10:12:48 Exception  -  NullReferenceException: Object reference not set to an instance of an object.\r\n" +
+			"  at VRC.UI.PageWorldInfo.Update () [0x00000] in <00000000000000000000000000000000>:0 \r\n" +
+			"  at VRCFlowManagerVRC.Update () [0x00000] in <00000000000000000000000000000000>:0 \r\n" +
+			"\r\n" +
+			"\r\n" +
+			"2021.02.14 10:12:49 Log        -  [API] Fetching user\r\n"))
+		expect := []logEntry{{Lines: []string{
+			"2021.02.14 10:12:48 Exception  -  NullReferenceException: Object reference not set to an instance of an object.",
+			"  at VRC.UI.PageWorldInfo.Update () [0x00000] in <00000000000000000000000000000000>:0 ",
+			"  at VRCFlowManagerVRC.Update () [0x00000] in <00000000000000000000000000000000>:0 ",
+		}}}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+		}
+
+		expect = []logEntry{{Lines: []string{"2021.02.14 10:12:49 Log        -  [API] Fetching user"}}}
+		if got := r.flush(); !reflect.DeepEqual(got, expect) {
+			t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+		}
+	})
+
+	t.Run("partial line", func(t *testing.T) {
+		r := &logEntryReader{}
+		if got := r.feed([]byte("2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_cc124ed6")); got != nil {
+			t.Errorf("partial line must be held %q", got)
+		}
+		if got := r.flush(); got != nil {
+			t.Errorf("partial line must not be flushed %q", got)
+		}
+		got := r.feed([]byte("-acec-4d55-9866-54ab66af172d\r\n\r\n"))
+		expect := []logEntry{{Lines: []string{"2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d"}}}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+		}
+	})
+
+	t.Run("duplicate entries", func(t *testing.T) {
+		content, err := ioutil.ReadFile(".test_data/duplicate_entries.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &logEntryReader{}
+		entries := append(r.feed(content), r.flush()...)
+
+		var headers []string
+		for _, e := range entries {
+			headers = append(headers, e.Header())
+		}
+		expect := []string{
+			"2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d",
+			"2021.02.14 10:12:49 Exception  -  NullReferenceException: Object reference not set to an instance of an object.",
+			"2021.02.14 10:12:50 Log        -  [Behaviour] Destination set: wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~nonce(86CB2A7F4E4AC916CD5A1313F656863C1E80BD2ED63738EA789E2B4C25B48F39)",
+		}
+		if !reflect.DeepEqual(headers, expect) {
+			t.Errorf("doesnt match \nexpect %q \ngot %q", expect, headers)
+		}
+	})
+}
+
+func TestCountMissedNotify(t *testing.T) {
+	// 安全のための読み込みごとの, 追記を読んだか, 通知が届いていたか
+	windows := []struct {
+		read     bool
+		notified bool
+		expect   int
+	}{
+		{true, false, 1},
+		{false, false, 1},
+		{true, true, 0},
+		{true, false, 1},
+		{true, false, 2},
+	}
+	missed := 0
+	for i, w := range windows {
+		missed = countMissedNotify(missed, w.read, w.notified)
+		if missed != w.expect {
+			t.Errorf("window %d expect %d got %d", i, w.expect, missed)
+		}
+	}
+}
+
+func TestLogFollower(t *testing.T) {
+	silent := func(closed *int32) func(string) (<-chan struct{}, func(), error) {
+		return func(string) (<-chan struct{}, func(), error) {
+			return make(chan struct{}), func() { atomic.StoreInt32(closed, 1) }, nil
+		}
+	}
+	broken := func(string) (<-chan struct{}, func(), error) {
+		return nil, nil, errors.New("not supported")
+	}
+
+	tests := []struct {
+		name     string
+		watch    func(closed *int32) func(string) (<-chan struct{}, func(), error)
+		fallback bool
+	}{
+		{name: "notify", watch: func(*int32) func(string) (<-chan struct{}, func(), error) { return watchLogFile }},
+		{name: "poll", watch: func(*int32) func(string) (<-chan struct{}, func(), error) { return nil }},
+		{name: "watch unavailable", watch: func(*int32) func(string) (<-chan struct{}, func(), error) { return broken }},
+		{name: "notification not delivered", watch: silent, fallback: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "vrcarjt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			path := filepath.Join(dir, "output_log_10-12-48.txt")
+			if err := ioutil.WriteFile(path, []byte("2021.02.14 10:12:48 Log        -  [API] old entry\r\n\r\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var closed int32
+			f := newLogFollower(path, stat.Size(), tt.watch(&closed))
+			f.safetyInterval = 100 * time.Millisecond
+			go f.run()
+			defer f.Stop()
+
+			file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			if _, err := file.WriteString("2021.02.14 10:12:49 Error      -  Timeout: Your connection to VRChat timed out.\r\n  at "); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(4 * f.safetyInterval)
+			if _, err := file.WriteString("VRC.Core.API\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case e := <-f.Entries():
+				expect := logEntry{Lines: []string{"2021.02.14 10:12:49 Error      -  Timeout: Your connection to VRChat timed out.", "  at VRC.Core.API"}}
+				if !reflect.DeepEqual(e, expect) {
+					t.Errorf("doesnt match \nexpect %q \ngot %q", expect, e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("entry not received")
+			}
+
+			// 通知が届かない追記が続いたらポーリングに切り替えて読み続ける
+			if _, err := file.WriteString("2021.02.14 10:12:50 Log        -  [API] next entry\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case e := <-f.Entries():
+				if e.Header() != "2021.02.14 10:12:50 Log        -  [API] next entry" {
+					t.Errorf("unexpected entry %q", e)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("entry not received")
+			}
+
+			if tt.fallback {
+				for i := 0; atomic.LoadInt32(&closed) == 0; i++ {
+					if i > 20 {
+						t.Fatal("expected fallback to polling")
+					}
+					time.Sleep(f.safetyInterval)
+				}
+			}
+		})
+	}
+}
+
+func TestStopPreviousFollower(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrcarjt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "output_log_10-12-48.txt")
+	if err := ioutil.WriteFile(path, []byte("2021.02.14 10:12:48 Log        -  [API] old entry\r\n\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 落ちた VRChat のログには行が来ないので, 次の Run と Stop で追跡と通知の監視を止める
+	follow := func() (*logFollower, *int32) {
+		var closed int32
+		f := newLogFollower(path, 0, func(string) (<-chan struct{}, func(), error) {
+			return make(chan struct{}), func() { atomic.StoreInt32(&closed, 1) }, nil
+		})
+		go f.run()
+		<-f.Entries()
+		return f, &closed
+	}
+	stopped := func(f *logFollower, closed *int32) bool {
+		select {
+		case _, ok := <-f.Entries():
+			if ok {
+				return false
+			}
+		case <-time.After(5 * time.Second):
+			return false
+		}
+		return atomic.LoadInt32(closed) == 1
+	}
+
+	v := newVRCAutoRejoinTool(&Setting{})
+	v.generation = 1
+	old, oldClosed := follow()
+	v.setFollower(1, old)
+
+	v.generation = 2
+	current, currentClosed := follow()
+	v.setFollower(1, current)
+	if !stopped(current, currentClosed) {
+		t.Error("follower of an old generation must be stopped")
+	}
+
+	v.rejoinLock.Lock()
+	v.stopFollower()
+	v.rejoinLock.Unlock()
+	if !stopped(old, oldClosed) {
+		t.Error("previous follower must be stopped")
+	}
+
+	next, nextClosed := follow()
+	v.setFollower(2, next)
+	if err := v.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !stopped(next, nextClosed) {
+		t.Error("Stop must stop the follower")
+	}
+}
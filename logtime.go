@@ -0,0 +1,61 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultLogTimeSkew はログの時刻と監視を始めた時刻のずれとして許容する幅
+const defaultLogTimeSkew = time.Minute
+
+// logLocation は log_timezone からログの時刻のタイムゾーンを返す
+// 空か Local のときは OS のタイムゾーン, +09:00 のような形式のときは固定のオフセットを使う
+func logLocation(name string) (*time.Location, error) {
+	switch name {
+	case "", "Local":
+		return time.Local, nil
+	}
+
+	if len(name) == len("+09:00") && (name[0] == '+' || name[0] == '-') {
+		t, err := time.Parse("-07:00", name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log_timezone %q: %w", name, err)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(name, offset), nil
+	}
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid log_timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// logTimeNotBefore はログの時刻 t が at 以降かを skew の分だけ遡って判定する
+// 夏時間が終わって同じ時刻が 2 回あるときはどちらかが at 以降であればよい
+func logTimeNotBefore(t time.Time, at time.Time, skew time.Duration) bool {
+	for _, c := range sameWallClock(t) {
+		if !c.Before(at.Add(-skew)) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameWallClock は t と同じタイムゾーンで同じ時刻と表示されるすべての時刻を返す
+func sameWallClock(t time.Time) []time.Time {
+	times := []time.Time{t}
+	_, offset := t.Zone()
+	for _, d := range []time.Duration{-3 * time.Hour, 3 * time.Hour} {
+		_, o := t.Add(d).Zone()
+		if o == offset {
+			continue
+		}
+		c := t.Add(time.Duration(offset-o) * time.Second)
+		if c.Format(TimeFormat) == t.Format(TimeFormat) {
+			times = append(times, c)
+		}
+	}
+	return times
+}
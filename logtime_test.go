@@ -0,0 +1,102 @@
+package vrcarjt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset int
+		err    bool
+	}{
+		{name: "+09:00", offset: 9 * 60 * 60},
+		{name: "-05:30", offset: -(5*60 + 30) * 60},
+		{name: "UTC", offset: 0},
+		{name: "+9", err: true},
+		{name: "Not/AZone", err: true},
+	}
+
+	at := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loc, err := logLocation(test.name)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if _, offset := at.In(loc).Zone(); offset != test.offset {
+				t.Errorf("expect %d got %d", test.offset, offset)
+			}
+		})
+	}
+
+	if loc, err := logLocation(""); err != nil || loc != time.Local {
+		t.Errorf("empty must be local got %v %v", loc, err)
+	}
+}
+
+func TestLogTimeNotBefore(t *testing.T) {
+	at := time.Date(2021, 2, 14, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		t      time.Time
+		expect bool
+	}{
+		{name: "after", t: at.Add(time.Second), expect: true},
+		{name: "within skew", t: at.Add(-30 * time.Second), expect: true},
+		{name: "before skew", t: at.Add(-2 * time.Minute), expect: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := logTimeNotBefore(test.t, at, time.Minute); got != test.expect {
+				t.Errorf("expect %v got %v", test.expect, got)
+			}
+		})
+	}
+
+	t.Run("end of daylight saving time", func(t *testing.T) {
+		loc, err := time.LoadLocation("America/New_York")
+		if err != nil {
+			t.Skip(err)
+		}
+		// 01:30 は夏時間と標準時で 2 回ある. 2 回目の 01:15 に監視を始めてもその後の 01:30 のログは移動として扱う
+		at := time.Date(2021, 11, 7, 6, 15, 0, 0, time.UTC)
+		lt, err := time.ParseInLocation(TimeFormat, "2021.11.07 01:30:00", loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !logTimeNotBefore(lt, at, 0) {
+			t.Error("expected the second 01:30 to be after start")
+		}
+		if logTimeNotBefore(lt, at.Add(time.Hour), 0) {
+			t.Error("expected 01:30 to be before 02:15")
+		}
+	})
+}
+
+func TestMoveInLogTimezone(t *testing.T) {
+	line := `2021.02.14 19:00:10 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d`
+	// ログの 19:00 は +09:00 では 10:00 UTC
+	at := time.Date(2021, 2, 14, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		timezone string
+		expect   bool
+	}{
+		{timezone: "+09:00", expect: true},
+		{timezone: "Asia/Tokyo", expect: true},
+		{timezone: "+10:00", expect: false},
+	}
+	for _, test := range tests {
+		t.Run(test.timezone, func(t *testing.T) {
+			v := newVRCAutoRejoinTool(&Setting{LogTimezone: test.timezone, LogTimeSkewSeconds: 60})
+			if got := v.isMove(at, line); got != test.expect {
+				t.Errorf("expect %v got %v", test.expect, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// moderationEvents はモデレーションのログと rejoin の理由. 投票でのキックは普通のキックのパターンにも一致するので先に調べる
+var moderationEvents = []struct {
+	event LogEvent
+	cause RejoinCause
+}{
+	{EventBanned, CauseBan},
+	{EventVoteKicked, CauseVoteKick},
+	{EventKicked, CauseKick},
+}
+
+func isModeration(cause RejoinCause) bool {
+	for _, m := range moderationEvents {
+		if m.cause == cause {
+			return true
+		}
+	}
+	return false
+}
+
+// moderationOf は line がモデレーションのログのときに理由を返す
+func (c *moveClassifier) moderationOf(line string) (RejoinCause, bool) {
+	for _, m := range moderationEvents {
+		if _, ok := c.patterns.Match(m.event, line); ok {
+			return m.cause, true
+		}
+	}
+	return "", false
+}
+
+// moderatedBefore は at の直前にキックや BAN のログがあればその理由を返す
+func (c *moveClassifier) moderatedBefore(at time.Time) (RejoinCause, bool) {
+	if c.moderated.IsZero() || c.moderated.After(at) || at.Sub(c.moderated) > moveContextWindow {
+		return "", false
+	}
+	return c.moderation, true
+}
+
+// blockedTarget はキックや BAN で戻らないことにしたインスタンス. BAN のときはワールド全体を記録する
+// Until を過ぎたら他の理由で戻ることを止めない
+type blockedTarget struct {
+	ID    string      `json:"id"`
+	Cause RejoinCause `json:"cause"`
+	Until time.Time   `json:"until"`
+}
+
+// キックされたインスタンスには VRChat でも 1 時間入れない. BAN は長めに 1 日戻らない
+const (
+	kickBlockDuration = time.Hour
+	banBlockDuration  = 24 * time.Hour
+)
+
+func blockDuration(cause RejoinCause) time.Duration {
+	if cause == CauseBan {
+		return banBlockDuration
+	}
+	return kickBlockDuration
+}
+
+// activeBlocks は at の時点でまだ戻らないことにしているものだけを返す
+func activeBlocks(blocked []blockedTarget, at time.Time) []blockedTarget {
+	active := []blockedTarget{}
+	for _, b := range blocked {
+		if at.Before(b.Until) {
+			active = append(active, b)
+		}
+	}
+	return active
+}
+
+// refuseRejoin はモデレーションで追い出されたときや追い出されたインスタンスに戻ろうとしたときに true を返す
+// 追い出されたときは理由を通知し, 固定していなければ移動先を戻るインスタンスにする
+func (v *VRCAutoRejoinTool) refuseRejoin(cause RejoinCause, target Instance, destination Instance) bool {
+	now := v.clock.Now()
+	if !isModeration(cause) {
+		v.targetLock.Lock()
+		v.blocked = activeBlocks(v.blocked, now)
+		blocked := v.blocked
+		v.targetLock.Unlock()
+		for _, b := range blocked {
+			if target.ID != "" && SameInstance(target.ID, b.ID) {
+				log.Println("refuse to rejoin", target.ID, "because of", b.Cause, "until", b.Until.Format(TimeFormat))
+				return true
+			}
+		}
+		return false
+	}
+
+	id := target.ID
+	if cause == CauseBan {
+		id = worldOf(target.ID)
+	}
+	if id != "" {
+		v.targetLock.Lock()
+		v.blocked = append(activeBlocks(v.blocked, now), blockedTarget{ID: id, Cause: cause, Until: now.Add(blockDuration(cause))})
+		v.targetLock.Unlock()
+		v.saveState(v.IsRun())
+	}
+	v.publish(EventModeration, target.ID, fmt.Sprintf("%s from %s. not rejoining", cause, target.ID))
+	if destination.ID != "" && !v.isPinned() {
+		v.retarget(destination, string(cause))
+	}
+	return true
+}
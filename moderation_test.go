@@ -0,0 +1,119 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModeration(t *testing.T) {
+	const start = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)~nonce(86CB2A7F4E4AC916)"
+	const home = "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:99999~region(jp)"
+
+	tests := []struct {
+		fixture string
+		cause   RejoinCause
+		rejoin  bool
+		target  string
+	}{
+		{fixture: "moderation_kick.txt", cause: CauseKick, target: home},
+		{fixture: "moderation_vote_kick.txt", cause: CauseVoteKick, target: home},
+		{fixture: "moderation_ban.txt", cause: CauseBan, target: home},
+		{fixture: "moderation_ban_join.txt", cause: CauseBan, target: home},
+		{fixture: "moderation_kick_timeout.txt", cause: CauseKick, target: start},
+		{fixture: "moderation_other_kicked.txt", cause: CauseMove, rejoin: true, target: start},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			content, err := ioutil.ReadFile(filepath.Join(".test_data", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.ReplaceAll(string(content), "\r", ""), "\n")
+
+			v := newVRCAutoRejoinTool(&Setting{})
+			v.LatestInstance = Instance{ID: start}
+			v.playSound = func(string) {}
+			v.clock = &fakeClock{now: time.Date(2021, 2, 14, 4, 0, 0, 0, time.Local)}
+
+			at := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+			var cause RejoinCause
+			rejoin := false
+			for _, line := range lines {
+				if line == "" {
+					continue
+				}
+				destination, c, moved := v.detectRejoin(at, line)
+				if !moved {
+					continue
+				}
+				cause = c
+				rejoin = v.decideRejoin(c, destination)
+				break
+			}
+
+			if cause != test.cause {
+				t.Errorf("cause expect %q got %q", test.cause, cause)
+			}
+			if rejoin != test.rejoin {
+				t.Errorf("rejoin expect %v got %v", test.rejoin, rejoin)
+			}
+			if v.LatestInstance.ID != test.target {
+				t.Errorf("target expect %q got %q", test.target, v.LatestInstance.ID)
+			}
+			moderated := false
+			for _, e := range v.Events() {
+				if e.Type == EventModeration {
+					moderated = true
+				}
+			}
+			if moderated == test.rejoin {
+				t.Errorf("moderation event expect %v got %v", !test.rejoin, moderated)
+			}
+
+			// 追い出されたインスタンスには他の理由でも戻らない
+			if !test.rejoin && test.target == start && v.decideRejoin(CauseCrash, Instance{}) {
+				t.Error("expect refusing to rejoin the kicked instance")
+			}
+		})
+	}
+}
+
+func TestModerationBlockExpires(t *testing.T) {
+	const kicked = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"
+	const banned = "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"
+	c := &fakeClock{now: time.Date(2021, 2, 14, 4, 0, 0, 0, time.Local)}
+	v := newVRCAutoRejoinTool(&Setting{})
+	v.clock = c
+	v.playSound = func(string) {}
+
+	v.refuseRejoin(CauseKick, Instance{ID: kicked}, Instance{})
+	v.refuseRejoin(CauseBan, Instance{ID: banned}, Instance{})
+
+	tests := []struct {
+		after   time.Duration
+		kicked  bool
+		banned  bool
+		remains int
+	}{
+		{after: 59 * time.Minute, kicked: true, banned: true, remains: 2},
+		{after: time.Hour, kicked: false, banned: true, remains: 1},
+		{after: 24 * time.Hour, kicked: false, banned: false, remains: 0},
+	}
+	start := c.now
+	for _, test := range tests {
+		c.now = start.Add(test.after)
+		if got := v.refuseRejoin(CauseCrash, Instance{ID: kicked}, Instance{}); got != test.kicked {
+			t.Errorf("after %s: kicked instance expect refused %v got %v", test.after, test.kicked, got)
+		}
+		if got := v.refuseRejoin(CauseCrash, Instance{ID: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:99999"}, Instance{}); got != test.banned {
+			t.Errorf("after %s: banned world expect refused %v got %v", test.after, test.banned, got)
+		}
+		if len(v.blocked) != test.remains {
+			t.Errorf("after %s: expired blocks must be dropped %v", test.after, v.blocked)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package vrcarjt
+
+import (
+	"log"
+	"time"
+)
+
+// MoveKind is the reason why the client moved to another instance
+type MoveKind string
+
+const (
+	// MoveForced はタイムアウトや切断, エラーでホームに戻された移動
+	MoveForced MoveKind = "forced"
+	// MoveIntentional はポータルやメニューから自分で入った移動
+	MoveIntentional MoveKind = "intentional"
+)
+
+// moveContextWindow は移動の前のログを移動の理由として扱う時間
+const moveContextWindow = 2 * time.Minute
+
+// moveClassifier は移動の直前のログから移動が強制されたものか自分で移動したものかを判定する
+type moveClassifier struct {
+	patterns  *PatternRegistry
+	location  *time.Location
+	homeWorld string
+
+	disconnected time.Time
+	requested    Instance
+	portal       time.Time
+	moderated    time.Time
+	moderation   RejoinCause
+	joinFailed   time.Time
+	joinFailure  RejoinCause
+}
+
+func newMoveClassifier(patterns *PatternRegistry, loc *time.Location, homeWorld string) *moveClassifier {
+	return &moveClassifier{patterns: patterns, location: loc, homeWorld: homeWorld}
+}
+
+// observe は移動の理由になるログを記録する. 移動先が決まったら記録を消す
+func (c *moveClassifier) observe(line string) {
+	lt, err := parseLogTime(line, c.location)
+	if err != nil {
+		return
+	}
+
+	if _, ok := c.patterns.Match(EventDestination, line); ok {
+		c.disconnected = time.Time{}
+		c.requested = Instance{}
+		c.portal = time.Time{}
+		c.moderated = time.Time{}
+		c.moderation = ""
+		c.joinFailed = time.Time{}
+		c.joinFailure = ""
+		return
+	}
+	if cause, ok := c.joinFailureOf(line); ok {
+		c.joinFailed, c.joinFailure = lt, cause
+		return
+	}
+	if cause, ok := c.moderationOf(line); ok {
+		c.moderated, c.moderation = lt, cause
+		return
+	}
+	if _, ok := c.patterns.Match(EventTimeout, line); ok {
+		c.disconnected = lt
+		return
+	}
+	if _, ok := c.patterns.Match(EventDisconnect, line); ok {
+		c.disconnected = lt
+		return
+	}
+	if groups, ok := c.patterns.Match(EventDestinationRequested, line); ok {
+		c.requested = Instance{ID: groups["instance"], Time: lt}
+		return
+	}
+	if _, ok := c.patterns.Match(EventPortal, line); ok {
+		c.portal = lt
+	}
+}
+
+// classify は移動先 i に移動した理由を判定する. 強制された移動のときは rejoin の理由も返す
+// 判断できないときは今まで通り戻るように強制された移動として扱う
+func (c *moveClassifier) classify(i Instance) (MoveKind, string, RejoinCause) {
+	within := func(t time.Time) bool {
+		return !t.IsZero() && !t.After(i.Time) && i.Time.Sub(t) <= moveContextWindow
+	}
+
+	if within(c.moderated) {
+		return MoveForced, string(c.moderation) + " before move", c.moderation
+	}
+	if within(c.disconnected) {
+		return MoveForced, "disconnected before move", CauseDisconnect
+	}
+	if within(c.requested.Time) && SameInstance(i.ID, worldOf(c.requested.ID)) {
+		return MoveIntentional, "joined from menu", ""
+	}
+	if within(c.portal) {
+		return MoveIntentional, "entered portal", ""
+	}
+	if c.homeWorld != "" && SameInstance(i.ID, c.homeWorld) {
+		return MoveForced, "returned to home world", CauseHome
+	}
+	return MoveForced, "unknown reason", CauseMove
+}
+
+// worldOf は instance ID のワールド ID を返す
+func worldOf(id string) string {
+	i, err := ParseInstanceID(id)
+	if err != nil {
+		return id
+	}
+	return i.WorldID
+}
+
+// forcedMove は移動先のログ line が戻るべき移動かを返す. 戻るときは移動先と rejoin の理由も返す
+// 自分で移動したときは戻るインスタンスを移動先に変える. 固定したインスタンスがあるときはそのままにする
+func (v *VRCAutoRejoinTool) forcedMove(line string) (Instance, RejoinCause, bool) {
+	i, err := v.patterns.Instance(line, v.location)
+	if err != nil {
+		return i, CauseMove, true
+	}
+	kind, reason, cause := v.moves.classify(i)
+	log.Println("move classified as", kind, "("+reason+")", i.ID)
+	if kind == MoveForced {
+		v.cancelCandidate()
+		return i, cause, true
+	}
+
+	if !v.isPinned() {
+		v.settle(i, reason)
+	}
+	return i, "", false
+}
@@ -0,0 +1,70 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClassifyMove(t *testing.T) {
+	const home = "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"
+	const start = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)~nonce(86CB2A7F4E4AC916)"
+
+	tests := []struct {
+		name    string
+		fixture string
+		pinned  string
+		forced  bool
+		target  string
+	}{
+		{name: "portal", fixture: "move_portal.txt", target: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"},
+		{name: "menu", fixture: "move_menu.txt", target: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"},
+		{name: "portal with pinned target", fixture: "move_portal.txt", pinned: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)", target: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)"},
+		{name: "disconnected to home", fixture: "move_disconnect_home.txt", forced: true, target: start},
+		{name: "home without context", fixture: "move_home.txt", forced: true, target: start},
+		{name: "unknown reason", fixture: "different_world.txt", forced: true, target: start},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, err := ioutil.ReadFile(filepath.Join(".test_data", test.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.ReplaceAll(string(content), "\r", ""), "\n")
+
+			v := newVRCAutoRejoinTool(&Setting{HomeWorld: home})
+			v.LatestInstance = Instance{ID: start}
+			v.playSound = func(string) {}
+			if test.pinned != "" {
+				if err := v.Pin(0, test.pinned); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			at := time.Date(2000, 1, 1, 0, 0, 0, 0, time.Local)
+			forced := false
+			for _, line := range lines {
+				if line == "" {
+					continue
+				}
+				if v.isMove(at, line) {
+					if _, _, ok := v.forcedMove(line); ok {
+						forced = true
+						break
+					}
+				}
+				v.moves.observe(line)
+			}
+
+			if forced != test.forced {
+				t.Errorf("forced expect %v got %v", test.forced, forced)
+			}
+			if v.LatestInstance.ID != test.target {
+				t.Errorf("target expect %q got %q", test.target, v.LatestInstance.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notify はログに出力し, notify_webhook が設定されていれば Webhook にも送る
+// Slack と Discord のどちらでも表示できるように text と content の両方に同じ文章を入れる
+func (v *VRCAutoRejoinTool) notify(title string, message string) {
+	text := fmt.Sprintf("[vrc_auto_rejoin_tool] %s: %s", title, message)
+	log.Println(text)
+
+	if v.Config.NotifyWebhook == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]string{
+		"text":    text,
+		"content": text,
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	res, err := notifyClient.Post(v.Config.NotifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Println("notify webhook failed:", res.Status)
+	}
+}
@@ -0,0 +1,26 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	v := newVRCAutoRejoinTool(&Setting{NotifyWebhook: server.URL})
+	v.notify("planned restart", "memory usage 9216MB exceeded 8192MB")
+
+	expect := "[vrc_auto_rejoin_tool] planned restart: memory usage 9216MB exceeded 8192MB"
+	if got["text"] != expect || got["content"] != expect {
+		t.Errorf("expect %q got %v", expect, got)
+	}
+}
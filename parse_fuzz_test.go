@@ -0,0 +1,62 @@
+//go:build go1.18
+// +build go1.18
+
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addLogCorpus は .test_data のログを 1 行ずつ seed corpus にする
+func addLogCorpus(f *testing.F, whole bool) {
+	files, err := filepath.Glob(".test_data/*.txt")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		if whole {
+			f.Add(string(content))
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			f.Add(line)
+		}
+	}
+}
+
+func FuzzNewInstanceByLog(f *testing.F) {
+	addLogCorpus(f, false)
+	f.Fuzz(func(t *testing.T, line string) {
+		i, err := NewInstanceByLog(line)
+		if err != nil {
+			if i != (Instance{}) {
+				t.Fatalf("instance must be empty on error %v", i)
+			}
+			return
+		}
+		if !strings.HasPrefix(i.ID, "wrld_") || !strings.Contains(line, i.ID) {
+			t.Fatalf("invalid instance %q from %q", i.ID, line)
+		}
+	})
+}
+
+func FuzzParseLatestInstance(f *testing.F) {
+	addLogCorpus(f, true)
+	v := NewVRCAutoRejoinTool()
+	f.Fuzz(func(t *testing.T, content string) {
+		i, err := v.parseLatestInstance(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.ID != "" && !strings.Contains(content, i.ID) {
+			t.Fatalf("invalid instance %q", i.ID)
+		}
+	})
+}
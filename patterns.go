@@ -0,0 +1,244 @@
+package vrcarjt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// LogEvent is a kind of event detected from the VRChat log
+type LogEvent string
+
+const (
+	// EventDestination はインスタンスの移動先が決まったときのログ. instance の名前付きグループで instance ID を取り出す
+	EventDestination LogEvent = "destination"
+	// EventTimeout は VRChat との接続が切れたときのログ
+	EventTimeout LogEvent = "timeout"
+	// EventDisconnect はタイムアウト以外でサーバーから切断されたときのログ
+	EventDisconnect LogEvent = "disconnect"
+	// EventDestinationRequested はメニューや招待から移動先を選んだときのログ
+	EventDestinationRequested LogEvent = "destination_requested"
+	// EventPortal はポータルに入ったときのログ
+	EventPortal LogEvent = "portal"
+	// EventAuthenticated はログインしたときのログ. name の名前付きグループで自分の表示名, あれば user でユーザー ID を取り出す
+	EventAuthenticated LogEvent = "authenticated"
+	// EventPlayerJoined, EventPlayerLeft はプレイヤーが出入りしたときのログ. name の名前付きグループで表示名を取り出す
+	EventPlayerJoined LogEvent = "player_joined"
+	EventPlayerLeft   LogEvent = "player_left"
+	// EventLeftRoom は自分がインスタンスを出たときのログ
+	EventLeftRoom LogEvent = "left_room"
+	// EventKicked, EventVoteKicked, EventBanned は自分がインスタンスからキックされたり, BAN されたときのログ
+	// ワールドの Udon やチャットの文字列に一致しないように [ModerationManager] などの出力元から始まる行だけに一致させる
+	EventKicked     LogEvent = "kicked"
+	EventVoteKicked LogEvent = "vote_kicked"
+	EventBanned     LogEvent = "banned"
+	// EventInstanceFull, EventInstanceClosed, EventWorldLoadFailed はインスタンスに入れなかったときのログ
+	// [Behaviour] の Failed to join instance と [AssetBundleDownloadManager] の行だけに一致させる
+	EventInstanceFull    LogEvent = "instance_full"
+	EventInstanceClosed  LogEvent = "instance_closed"
+	EventWorldLoadFailed LogEvent = "world_load_failed"
+	// EventRoomName は入ったワールドの名前のログ. name の名前付きグループでワールド名を取り出す
+	EventRoomName LogEvent = "room_name"
+)
+
+// requiredGroups はイベントごとに必ず必要な名前付きグループ
+var requiredGroups = map[LogEvent][]string{
+	EventDestination:          {"instance"},
+	EventDestinationRequested: {"instance"},
+	EventAuthenticated:        {"name"},
+	EventPlayerJoined:         {"name"},
+	EventPlayerLeft:           {"name"},
+	EventRoomName:             {"name"},
+}
+
+// defaultLogPatterns は組み込みのパターン. ログの形式が変わったときは setting.yml の log_patterns で追加, 上書きする
+var defaultLogPatterns = map[LogEvent][]string{
+	EventDestination:          {`\] Destination set: (?P<instance>wrld_.+)$`},
+	EventTimeout:              {regexp.QuoteMeta(Timeout)},
+	EventDisconnect:           {`\] (OnDisconnected|OnConnectionFail|Lost connection to)`},
+	EventDestinationRequested: {`\] Destination requested: (?P<instance>wrld_.+)$`},
+	EventPortal:               {`(?i)\] (entering|using) portal`},
+	EventAuthenticated:        {`User Authenticated: (?P<name>.+?)(?: \((?P<user>usr_[^)]*)\))?$`},
+	EventPlayerJoined:         {`\] OnPlayerJoined (?P<name>.+?)(?: \(usr_[^)]*\))?$`},
+	EventPlayerLeft:           {`\] OnPlayerLeft (?P<name>.+?)(?: \(usr_[^)]*\))?$`},
+	EventLeftRoom:             {`\] OnLeftRoom$`},
+	EventRoomName:             {`\] (?:Joining or Creating Room|Entering Room): (?P<name>.+)$`},
+	EventKicked:               {`\[ModerationManager\] You have been kicked from (?:the|this) (?:instance|world)`},
+	EventVoteKicked:           {`\[(?:ModerationManager|Behaviour)\] (?:Received executive message: )?You have been kicked from the instance by majority vote`},
+	EventBanned:               {`\[ModerationManager\] You have been banned from (?:the|this) (?:instance|world)`, `\[Behaviour\] Failed to join instance '[^']*' due to 'You (?:are|have been) banned`},
+	EventInstanceFull:         {`\[Behaviour\] Failed to join instance '[^']*' due to '(?:That|This) instance is full`},
+	EventInstanceClosed:       {`\[Behaviour\] Failed to join instance '[^']*' due to '(?:That|This) instance (?:has been |is )?closed`},
+	EventWorldLoadFailed:      {`\[AssetBundleDownloadManager\] (?:Failed to load|Error loading|Error downloading) world`},
+}
+
+// LogPatternSetting は setting.yml でイベントに追加するパターン
+// replace が true のときは組み込みのパターンを使わずに patterns だけを使う
+type LogPatternSetting struct {
+	Replace  bool     `yaml:"replace"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// PatternRegistry maps log events to the regexps which detect them
+type PatternRegistry struct {
+	patterns map[LogEvent][]*regexp.Regexp
+}
+
+// PatternMatch is a log line matched by a pattern
+type PatternMatch struct {
+	Event   LogEvent
+	Pattern string
+	Groups  map[string]string
+}
+
+var defaultPatterns = mustPatternRegistry(nil)
+
+func mustPatternRegistry(conf map[LogEvent]LogPatternSetting) *PatternRegistry {
+	r, err := NewPatternRegistry(conf)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// NewPatternRegistry は組み込みのパターンに conf のパターンを加えた PatternRegistry を返す
+// 組み込みにないイベントは書き間違いなので使わずにエラーにする
+func NewPatternRegistry(conf map[LogEvent]LogPatternSetting) (*PatternRegistry, error) {
+	r := &PatternRegistry{patterns: map[LogEvent][]*regexp.Regexp{}}
+
+	for event := range conf {
+		if _, ok := defaultLogPatterns[event]; !ok {
+			return nil, fmt.Errorf("unknown log_patterns event %q. known events are %s", event, knownLogEvents())
+		}
+	}
+
+	for event, patterns := range defaultLogPatterns {
+		if conf[event].Replace {
+			continue
+		}
+		if err := r.add(event, patterns); err != nil {
+			return nil, err
+		}
+	}
+	for event, c := range conf {
+		if err := r.add(event, c.Patterns); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func knownLogEvents() string {
+	events := make([]string, 0, len(defaultLogPatterns))
+	for event := range defaultLogPatterns {
+		events = append(events, string(event))
+	}
+	sort.Strings(events)
+	return strings.Join(events, ", ")
+}
+
+func (r *PatternRegistry) add(event LogEvent, patterns []string) error {
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", event, p, err)
+		}
+		for _, group := range requiredGroups[event] {
+			if re.SubexpIndex(group) < 0 {
+				return fmt.Errorf("%s pattern %q must have named group (?P<%s>...)", event, p, group)
+			}
+		}
+		r.patterns[event] = append(r.patterns[event], re)
+	}
+	return nil
+}
+
+// Match は line が event のパターンのどれかに一致したときに名前付きグループの値を返す
+func (r *PatternRegistry) Match(event LogEvent, line string) (map[string]string, bool) {
+	for _, re := range r.patterns[event] {
+		if groups, ok := matchGroups(re, line); ok {
+			return groups, true
+		}
+	}
+	return nil, false
+}
+
+// MatchAll は line に一致したすべてのイベントとパターンをイベント名の順に返す
+func (r *PatternRegistry) MatchAll(line string) []PatternMatch {
+	var matches []PatternMatch
+	for _, event := range r.Events() {
+		for _, re := range r.patterns[event] {
+			if groups, ok := matchGroups(re, line); ok {
+				matches = append(matches, PatternMatch{Event: event, Pattern: re.String(), Groups: groups})
+			}
+		}
+	}
+	return matches
+}
+
+// Events は登録されているイベントを名前の順に返す
+func (r *PatternRegistry) Events() []LogEvent {
+	events := make([]LogEvent, 0, len(r.patterns))
+	for event := range r.patterns {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i] < events[j] })
+	return events
+}
+
+// Instance は移動先のログから Instance を取り出す. ログの時刻は loc のものとして扱う
+func (r *PatternRegistry) Instance(line string, loc *time.Location) (Instance, error) {
+	groups, ok := r.Match(EventDestination, line)
+	if !ok {
+		return Instance{}, ErrWorldLogNotFound
+	}
+	return newInstanceByLog(line, groups["instance"], loc)
+}
+
+func matchGroups(re *regexp.Regexp, line string) (map[string]string, bool) {
+	m := re.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false
+	}
+	groups := map[string]string{}
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			groups[name] = m[i]
+		}
+	}
+	return groups, true
+}
+
+// WriteMatches は src の各行に一致したパターンを w に書き出す
+func (r *PatternRegistry) WriteMatches(w io.Writer, src io.Reader) error {
+	s := bufio.NewScanner(src)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for s.Scan() {
+		n++
+		line := strings.TrimRight(s.Text(), "\r")
+		for _, m := range r.MatchAll(line) {
+			if _, err := fmt.Fprintf(w, "%d: %s %s%s\n\t%s\n", n, m.Event, m.Pattern, formatGroups(m.Groups), line); err != nil {
+				return err
+			}
+		}
+	}
+	return s.Err()
+}
+
+func formatGroups(groups map[string]string) string {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%q", name, groups[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,130 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPatternRegistry(t *testing.T) {
+	tofu := `2019.08.18 21:02:38 Log        -  [ǅǅǄǄǅǅǄǅǄǄǄǅǅǅǄǄǅǅǅǅǅǅǅǄǄǄǅǅǅǅǄǅǅǅǄǅǄǄǅǅǄǅǄǅǄǄǄ] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d`
+	joining := `2019.08.18 21:02:38 Log        -  [Behaviour] Joining wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)`
+	timeout := `2021.02.14 10:12:48 Error      -  [ǅǅǅǅǄǄǅǅǄǅǄǄǄǄǄǅǅǄǄǄǅǄǅǄǄǅǄǅǄǅǄǅǄǄǅǄǄǄǅǄǄǅǄǄǄǄǅ] Timeout: Your connection to VRChat timed out.`
+
+	tests := []struct {
+		name     string
+		conf     map[LogEvent]LogPatternSetting
+		line     string
+		event    LogEvent
+		instance string
+		match    bool
+	}{
+		{name: "default destination", line: tofu, event: EventDestination, instance: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d", match: true},
+		{name: "default timeout", line: timeout, event: EventTimeout, match: true},
+		{name: "unknown wording", line: joining, event: EventDestination, match: false},
+		{name: "kicked", line: `2021.02.14 03:59:50 Log        -  [ModerationManager] You have been kicked from this instance.`, event: EventKicked, match: true},
+		{name: "kicked by a world", line: `2021.02.14 03:59:50 Log        -  [UdonBehaviour] You have been kicked from this instance.`, event: EventKicked, match: false},
+		{name: "other user kicked", line: `2021.02.14 03:59:50 Log        -  [ModerationManager] alice has been kicked from the instance.`, event: EventKicked, match: false},
+		{name: "instance full", line: `2021.02.14 04:00:20 Error      -  [Behaviour] Failed to join instance 'wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345' due to 'That instance is full.'`, event: EventInstanceFull, match: true},
+		{name: "full in a world name", line: `2021.02.14 04:00:20 Log        -  [Behaviour] Entering Room: this room is full`, event: EventInstanceFull, match: false},
+		{name: "banned in a world name", line: `2021.02.14 03:59:50 Log        -  [Behaviour] Entering Room: you have been banned`, event: EventBanned, match: false},
+		{
+			name:     "extended",
+			conf:     map[LogEvent]LogPatternSetting{EventDestination: {Patterns: []string{`\] Joining (?P<instance>wrld_.+)$`}}},
+			line:     joining,
+			event:    EventDestination,
+			instance: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)",
+			match:    true,
+		},
+		{
+			name:     "extended keeps default",
+			conf:     map[LogEvent]LogPatternSetting{EventDestination: {Patterns: []string{`\] Joining (?P<instance>wrld_.+)$`}}},
+			line:     tofu,
+			event:    EventDestination,
+			instance: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d",
+			match:    true,
+		},
+		{
+			name:  "replaced",
+			conf:  map[LogEvent]LogPatternSetting{EventTimeout: {Replace: true, Patterns: []string{`connection lost`}}},
+			line:  timeout,
+			event: EventTimeout,
+			match: false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r, err := NewPatternRegistry(test.conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, ok := r.Match(test.event, test.line)
+			if ok != test.match {
+				t.Fatalf("match expect %v got %v", test.match, ok)
+			}
+			if groups["instance"] != test.instance {
+				t.Errorf("instance expect %q got %q", test.instance, groups["instance"])
+			}
+		})
+	}
+}
+
+func TestPatternRegistryInvalid(t *testing.T) {
+	tests := map[string]map[LogEvent]LogPatternSetting{
+		"broken regexp": {EventTimeout: {Patterns: []string{`(`}}},
+		"missing group": {EventDestination: {Patterns: []string{`Joining wrld_.+`}}},
+		"unknown event": {"timout": {Patterns: []string{`timed out`}}},
+	}
+	for name, conf := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewPatternRegistry(conf); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestLogPatternsSetting(t *testing.T) {
+	var s Setting
+	conf := `
+log_patterns:
+  destination:
+    patterns:
+      - '\] Joining (?P<instance>wrld_.+)$'
+`
+	if err := yaml.Unmarshal([]byte(conf), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	v := newVRCAutoRejoinTool(&s)
+	v.LatestInstance = Instance{ID: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"}
+	at := time.Date(2019, 8, 18, 0, 0, 0, 0, time.Local)
+	if !v.isMove(at, `2019.08.18 21:02:38 Log        -  [Behaviour] Joining wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345`) {
+		t.Error("expected move by configured pattern")
+	}
+}
+
+func TestWriteMatches(t *testing.T) {
+	src := strings.Join([]string{
+		"2021.02.14 10:12:47 Log        -  [API] unrelated\r",
+		"2021.02.14 10:12:48 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d\r",
+		"2021.02.14 10:12:49 Error      -  Timeout: Your connection to VRChat timed out.\r",
+	}, "\n")
+
+	var out bytes.Buffer
+	if err := defaultPatterns.WriteMatches(&out, strings.NewReader(src)); err != nil {
+		t.Fatal(err)
+	}
+	expect := `2: destination \] Destination set: (?P<instance>wrld_.+)$ instance="wrld_cc124ed6-acec-4d55-9866-54ab66af172d"
+	2021.02.14 10:12:48 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d
+3: timeout Timeout: Your connection to VRChat timed out\.
+	2021.02.14 10:12:49 Error      -  Timeout: Your connection to VRChat timed out.
+`
+	if out.String() != expect {
+		t.Errorf("doesnt match \nexpect %s\ngot %s", expect, out.String())
+	}
+}
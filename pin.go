@@ -0,0 +1,108 @@
+package vrcarjt
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Bookmark is a named instance which can be pinned as the rejoin target
+type Bookmark struct {
+	Name string `yaml:"name" json:"name"`
+	// Target は instance ID, vrchat://launch の URL, vrchat.com の launch リンクのいずれか
+	Target string `yaml:"target" json:"target"`
+}
+
+var (
+	// ErrBookmarkNotFound is returned when neither an instance nor a bookmark matches the pin target
+	ErrBookmarkNotFound = errors.New("instance or bookmark not found")
+	// ErrProfileNotFound is returned when no client is monitored with the profile
+	ErrProfileNotFound = errors.New("profile not found")
+)
+
+// ParseInstanceTarget は instance ID, vrchat://launch?id=... の URL, https://vrchat.com/home/launch?worldId=...&instanceId=... のリンクから instance ID を取り出す
+func ParseInstanceTarget(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	id := s
+	if strings.Contains(s, "://") {
+		u, err := url.Parse(s)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		switch {
+		case strings.EqualFold(u.Scheme, "vrchat") && strings.EqualFold(u.Host, "launch"):
+			id = q.Get("id")
+		case (u.Scheme == "https" || u.Scheme == "http") && strings.HasSuffix(u.Host, "vrchat.com") && strings.HasSuffix(u.Path, "/launch"):
+			id = q.Get("worldId")
+			if instance := q.Get("instanceId"); instance != "" {
+				id += ":" + instance
+			}
+		default:
+			return "", fmt.Errorf("unsupported launch url %q", s)
+		}
+	}
+
+	if _, err := ParseInstanceID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// resolvePin は target を instance ID として読めなければ同じ名前の bookmark の instance ID を返す
+func resolvePin(target string, bookmarks []Bookmark) (Instance, error) {
+	if id, err := ParseInstanceTarget(target); err == nil {
+		return Instance{ID: id}, nil
+	}
+	for _, b := range bookmarks {
+		if b.Name != target {
+			continue
+		}
+		id, err := ParseInstanceTarget(b.Target)
+		if err != nil {
+			return Instance{}, fmt.Errorf("bookmark %q: %w", b.Name, err)
+		}
+		return Instance{ID: id}, nil
+	}
+	return Instance{}, fmt.Errorf("%w: %q", ErrBookmarkNotFound, target)
+}
+
+// Pin はログから読んだインスタンスの代わりに target を戻るインスタンスにする
+func (v *VRCAutoRejoinTool) Pin(profile int, target string) error {
+	if profile != v.Profile {
+		return fmt.Errorf("%w: %d", ErrProfileNotFound, profile)
+	}
+	i, err := resolvePin(target, v.Config.Bookmarks)
+	if err != nil {
+		return err
+	}
+	v.pin(i)
+	return nil
+}
+
+// Unpin は戻るインスタンスを次に Start したときにログから読むように戻す
+func (v *VRCAutoRejoinTool) Unpin(profile int) error {
+	if profile != v.Profile {
+		return fmt.Errorf("%w: %d", ErrProfileNotFound, profile)
+	}
+	v.targetLock.Lock()
+	v.pinned = Instance{}
+	v.targetLock.Unlock()
+	return nil
+}
+
+func (v *VRCAutoRejoinTool) Bookmarks() []Bookmark {
+	return v.Config.Bookmarks
+}
+
+func (v *VRCAutoRejoinTool) pin(i Instance) {
+	v.targetLock.Lock()
+	v.pinned = i
+	v.LatestInstance = i
+	v.fallbackStep = 0
+	v.fallbackTarget = Instance{}
+	v.targetLock.Unlock()
+	v.saveState(v.IsRun())
+}
@@ -0,0 +1,150 @@
+package vrcarjt
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseInstanceTarget(t *testing.T) {
+	const id = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)"
+	tests := []struct {
+		name   string
+		target string
+		expect string
+		err    bool
+	}{
+		{name: "instance id", target: id, expect: id},
+		{name: "world only", target: " wrld_cc124ed6-acec-4d55-9866-54ab66af172d\n", expect: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+		{name: "vrchat url", target: "vrchat://launch?ref=vrchat.com&id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)", expect: id},
+		{name: "web launch link", target: "https://vrchat.com/home/launch?worldId=wrld_cc124ed6-acec-4d55-9866-54ab66af172d&instanceId=12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)", expect: id},
+		{name: "web link without instance", target: "https://vrchat.com/home/launch?worldId=wrld_cc124ed6-acec-4d55-9866-54ab66af172d", expect: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+		{name: "other site", target: "https://example.com/launch?worldId=wrld_cc124ed6-acec-4d55-9866-54ab66af172d", err: true},
+		{name: "not an instance", target: "group sleep room", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseInstanceTarget(test.target)
+			if (err != nil) != test.err {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != test.expect {
+				t.Errorf("expect %q got %q", test.expect, got)
+			}
+		})
+	}
+}
+
+func TestPin(t *testing.T) {
+	conf := &Setting{Bookmarks: []Bookmark{
+		{Name: "group sleep room", Target: "https://vrchat.com/home/launch?worldId=wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b&instanceId=55555~region(jp)"},
+		{Name: "broken", Target: "wrld"},
+	}}
+
+	t.Run("bookmark overrides log target", func(t *testing.T) {
+		v := newVRCAutoRejoinTool(conf)
+		v.LatestInstance = Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"}
+		if err := v.Pin(0, "group sleep room"); err != nil {
+			t.Fatal(err)
+		}
+		if v.LatestInstance.ID != "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:55555~region(jp)" {
+			t.Errorf("unexpected target %q", v.LatestInstance.ID)
+		}
+		if s := v.Status(); !s[0].Pinned {
+			t.Error("status must be pinned")
+		}
+
+		// 固定したインスタンスに nonce 付きで入り直したときは移動として扱わない
+		at := time.Date(2021, 2, 14, 0, 0, 0, 0, time.Local)
+		if v.isMove(at, `2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:55555~region(jp)~nonce(86CB2A7F)`) {
+			t.Error("joining the pinned instance must not be a move")
+		}
+	})
+
+	t.Run("pin while watching the log", func(t *testing.T) {
+		// go test -race で API からの Pin とログの監視が同時に戻るインスタンスを読み書きしないことを確かめる
+		v := newVRCAutoRejoinTool(conf)
+		v.LatestInstance = Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"}
+		at := time.Date(2021, 2, 14, 0, 0, 0, 0, time.Local)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				v.isMove(at, `2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:55555~region(jp)`)
+				v.rejoinTarget()
+				v.Status()
+			}
+		}()
+		for i := 0; i < 100; i++ {
+			if err := v.Pin(0, "group sleep room"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		<-done
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		v := newVRCAutoRejoinTool(conf)
+		if err := v.Pin(1, "group sleep room"); !errors.Is(err, ErrProfileNotFound) {
+			t.Errorf("expect %v got %v", ErrProfileNotFound, err)
+		}
+		if err := v.Pin(0, "unknown"); !errors.Is(err, ErrBookmarkNotFound) {
+			t.Errorf("expect %v got %v", ErrBookmarkNotFound, err)
+		}
+		if err := v.Pin(0, "broken"); err == nil {
+			t.Error("broken bookmark must be error")
+		}
+	})
+
+	t.Run("client manager keeps pins until start", func(t *testing.T) {
+		m := &ClientManager{Config: conf, pins: map[int]Instance{}, lock: &sync.Mutex{}}
+		if err := m.Pin(2, "group sleep room"); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.pinned(2).ID; got != "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:55555~region(jp)" {
+			t.Errorf("unexpected pin %q", got)
+		}
+		if err := m.Unpin(2); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.pinned(2).ID; got != "" {
+			t.Errorf("pin must be removed got %q", got)
+		}
+	})
+}
+
+func TestAPIPin(t *testing.T) {
+	v := newVRCAutoRejoinTool(&Setting{})
+	h := NewAPIHandler(v)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"pin", http.MethodPost, "/api/pin", `{"profile": 0, "target": "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345"}`, http.StatusNoContent},
+		{"unknown profile", http.MethodPost, "/api/pin", `{"profile": 3, "target": "wrld_cc124ed6-acec-4d55-9866-54ab66af172d"}`, http.StatusNotFound},
+		{"invalid target", http.MethodPost, "/api/pin", `{"profile": 0, "target": "home"}`, http.StatusBadRequest},
+		{"invalid body", http.MethodPost, "/api/pin", `{`, http.StatusBadRequest},
+		{"unpin", http.MethodDelete, "/api/pin?profile=0", "", http.StatusNoContent},
+		{"bookmarks", http.MethodGet, "/api/bookmarks", "", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+			if rec.Code != test.code {
+				t.Errorf("expect %d got %d %s", test.code, rec.Code, rec.Body)
+			}
+		})
+	}
+	if v.pinned.ID != "" {
+		t.Errorf("pin must be removed got %q", v.pinned.ID)
+	}
+}
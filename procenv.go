@@ -0,0 +1,112 @@
+package vrcarjt
+
+import (
+	"log"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// ProcessContext は VRChat を立ち上げ直すときに引き継ぐ元のプロセスの実行環境
+type ProcessContext struct {
+	Dir string
+	Env []string
+}
+
+func readProcessContext(p *process.Process) ProcessContext {
+	pc := ProcessContext{}
+	if runtime.GOOS == "linux" {
+		log.Println("VRChat is relaunched through steam. the working directory and environment of VRChat are not passed to it.")
+		return pc
+	}
+
+	dir, err := processCwd(p.Pid)
+	if err != nil || dir == "" {
+		// 読めないときは Steam から起動したときと同じく exe のある場所にする
+		if exe, exeErr := p.Exe(); exeErr == nil {
+			dir = filepath.Dir(exe)
+		}
+		log.Println("failed to read the working directory of VRChat. relaunch in", dir, err)
+	}
+	pc.Dir = dir
+
+	env, err := processEnviron(p.Pid)
+	if err != nil {
+		log.Println("failed to read the environment of VRChat. relaunch with the environment of this tool.", err)
+	}
+	pc.Env = env
+
+	return pc
+}
+
+// filterEnv は allow と deny に一致する環境変数だけを残す
+// allow が空のときは deny 以外のすべてを残す. パターンには path.Match の * などが使える
+func filterEnv(env []string, allow []string, deny []string) []string {
+	var filtered []string
+	for _, kv := range env {
+		key := kv
+		if i := strings.Index(kv, "="); i > 0 {
+			key = kv[:i]
+		}
+		if len(allow) > 0 && !matchEnvKey(key, allow) {
+			continue
+		}
+		if matchEnvKey(key, deny) {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
+
+func matchEnvKey(key string, patterns []string) bool {
+	for _, pattern := range patterns {
+		// Windows の環境変数は大文字小文字を区別しない
+		ok, err := path.Match(strings.ToUpper(pattern), strings.ToUpper(key))
+		if err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeEnv は base に override を上書きした環境変数を返す
+func mergeEnv(base []string, override []string) []string {
+	index := map[string]int{}
+	merged := make([]string, 0, len(base)+len(override))
+	for _, kv := range append(append([]string{}, base...), override...) {
+		key := strings.ToUpper(strings.SplitN(kv, "=", 2)[0])
+		if i, ok := index[key]; ok {
+			merged[i] = kv
+			continue
+		}
+		index[key] = len(merged)
+		merged = append(merged, kv)
+	}
+	return merged
+}
+
+// splitEnvironmentBlock は NUL 区切りで NUL 2 つで終わる環境変数ブロックを分割する
+// =C:=C:\ のような = で始まるドライブごとのカレントディレクトリは除く
+func splitEnvironmentBlock(block []uint16) []string {
+	var env []string
+	start := 0
+	for i, c := range block {
+		if c != 0 {
+			continue
+		}
+		if i == start {
+			break
+		}
+		kv := string(utf16.Decode(block[start:i]))
+		if kv[0] != '=' {
+			env = append(env, kv)
+		}
+		start = i + 1
+	}
+	return env
+}
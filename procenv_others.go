@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package vrcarjt
+
+import "errors"
+
+var errProcessContextNotSupported = errors.New("reading the environment of another process is not supported")
+
+// Windows 以外では立ち上げ直すときにこのツールの実行環境を使う
+func processEnviron(pid int32) ([]string, error) {
+	return nil, errProcessContextNotSupported
+}
+
+func processCwd(pid int32) (string, error) {
+	return "", errProcessContextNotSupported
+}
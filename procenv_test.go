@@ -0,0 +1,53 @@
+package vrcarjt
+
+import (
+	"reflect"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"PATH=C:\\Windows", "MELONLOADER_DEBUG=1", "Temp=C:\\Temp", "STEAM_COMPAT_DATA_PATH=/tmp/pfx"}
+
+	tests := []struct {
+		Name   string
+		Allow  []string
+		Deny   []string
+		Expect []string
+	}{
+		{"allow all", nil, nil, env},
+		{"deny", nil, []string{"path", "TEMP"}, []string{"MELONLOADER_DEBUG=1", "STEAM_COMPAT_DATA_PATH=/tmp/pfx"}},
+		{"allow pattern", []string{"MELONLOADER_*", "STEAM_*"}, nil, []string{"MELONLOADER_DEBUG=1", "STEAM_COMPAT_DATA_PATH=/tmp/pfx"}},
+		{"deny wins", []string{"*"}, []string{"STEAM_*"}, []string{"PATH=C:\\Windows", "MELONLOADER_DEBUG=1", "Temp=C:\\Temp"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			got := filterEnv(env, test.Allow, test.Deny)
+			if !reflect.DeepEqual(got, test.Expect) {
+				t.Errorf("doesnt match \nexpect %q \ngot %q", test.Expect, got)
+			}
+		})
+	}
+}
+
+func TestMergeEnv(t *testing.T) {
+	base := []string{"PATH=C:\\Windows", "TEMP=C:\\Temp"}
+	got := mergeEnv(base, []string{"Path=D:\\Mods", "MELONLOADER_DEBUG=1"})
+	expect := []string{"Path=D:\\Mods", "TEMP=C:\\Temp", "MELONLOADER_DEBUG=1"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+	}
+	if base[0] != "PATH=C:\\Windows" {
+		t.Error("base must not be modified")
+	}
+}
+
+func TestSplitEnvironmentBlock(t *testing.T) {
+	block := utf16.Encode([]rune("=C:=C:\\VRChat\x00PATH=C:\\Windows\x00MELONLOADER_DEBUG=1\x00\x00garbage"))
+	got := splitEnvironmentBlock(block)
+	expect := []string{"PATH=C:\\Windows", "MELONLOADER_DEBUG=1"}
+	if !reflect.DeepEqual(got, expect) {
+		t.Errorf("doesnt match \nexpect %q \ngot %q", expect, got)
+	}
+}
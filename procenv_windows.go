@@ -0,0 +1,153 @@
+package vrcarjt
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// gopsutil は Windows で他プロセスの cwd と環境変数を取れないため, PEB の RTL_USER_PROCESS_PARAMETERS を読む
+// 同じビット数のプロセスだけを読める. 64bit の VRChat を読むにはこのツールも 64bit でビルドする
+
+var (
+	modntdll                      = windows.NewLazySystemDLL("ntdll.dll")
+	modkernel32                   = windows.NewLazySystemDLL("kernel32.dll")
+	procNtQueryInformationProcess = modntdll.NewProc("NtQueryInformationProcess")
+	procReadProcessMemory         = modkernel32.NewProc("ReadProcessMemory")
+	procIsWow64Process            = modkernel32.NewProc("IsWow64Process")
+)
+
+// processBasicInformation は PROCESS_BASIC_INFORMATION. ExitStatus と BasePriority もポインタの大きさに揃っている
+type processBasicInformation struct {
+	ExitStatus                   uintptr
+	PebBaseAddress               uintptr
+	AffinityMask                 uintptr
+	BasePriority                 uintptr
+	UniqueProcessID              uintptr
+	InheritedFromUniqueProcessID uintptr
+}
+
+// unicodeString は UNICODE_STRING
+type unicodeString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        uintptr
+}
+
+const ptrSize = unsafe.Sizeof(uintptr(0))
+
+// PEB と RTL_USER_PROCESS_PARAMETERS の中の位置
+var (
+	pebProcessParameters = 4 * ptrSize
+	paramsCurrentDir     = offsetFor(0x38, 0x24)
+	paramsEnvironment    = offsetFor(0x80, 0x48)
+	paramsEnvironmentLen = offsetFor(0x3F0, 0x290)
+)
+
+// offsetFor は 64bit と 32bit のうちこのツールのビット数の位置を返す
+func offsetFor(x64 uintptr, x86 uintptr) uintptr {
+	if ptrSize == 8 {
+		return x64
+	}
+	return x86
+}
+
+// maxEnvironmentSize は読む環境変数ブロックの上限
+const maxEnvironmentSize = 1 << 20
+
+func processEnviron(pid int32) ([]string, error) {
+	var env []string
+	err := withProcessParameters(pid, func(h windows.Handle, params uintptr) error {
+		var block, size uintptr
+		if err := readProcess(h, params+paramsEnvironment, unsafe.Pointer(&block), ptrSize); err != nil {
+			return err
+		}
+		if err := readProcess(h, params+paramsEnvironmentLen, unsafe.Pointer(&size), ptrSize); err != nil {
+			return err
+		}
+		if block == 0 || size == 0 || size > maxEnvironmentSize {
+			return fmt.Errorf("unexpected environment block size %d", size)
+		}
+		buf := make([]uint16, size/2)
+		if err := readProcess(h, block, unsafe.Pointer(&buf[0]), uintptr(len(buf))*2); err != nil {
+			return err
+		}
+		env = splitEnvironmentBlock(buf)
+		return nil
+	})
+	return env, err
+}
+
+func processCwd(pid int32) (string, error) {
+	var dir string
+	err := withProcessParameters(pid, func(h windows.Handle, params uintptr) error {
+		var s unicodeString
+		if err := readProcess(h, params+paramsCurrentDir, unsafe.Pointer(&s), unsafe.Sizeof(s)); err != nil {
+			return err
+		}
+		if s.Length == 0 || s.Buffer == 0 {
+			return errors.New("empty working directory")
+		}
+		buf := make([]uint16, s.Length/2)
+		if err := readProcess(h, s.Buffer, unsafe.Pointer(&buf[0]), uintptr(s.Length)); err != nil {
+			return err
+		}
+		dir = string(utf16.Decode(buf))
+		return nil
+	})
+	return dir, err
+}
+
+// withProcessParameters は pid のプロセスを開き, RTL_USER_PROCESS_PARAMETERS のアドレスを fn に渡す
+func withProcessParameters(pid int32, fn func(h windows.Handle, params uintptr) error) error {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION|windows.PROCESS_VM_READ, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(h)
+
+	if err := checkSameBitness(h); err != nil {
+		return err
+	}
+
+	var info processBasicInformation
+	status, _, _ := procNtQueryInformationProcess.Call(uintptr(h), 0, uintptr(unsafe.Pointer(&info)), unsafe.Sizeof(info), 0)
+	if status != 0 {
+		return fmt.Errorf("NtQueryInformationProcess failed with status 0x%x", status)
+	}
+	var params uintptr
+	if err := readProcess(h, info.PebBaseAddress+pebProcessParameters, unsafe.Pointer(&params), ptrSize); err != nil {
+		return err
+	}
+	return fn(h, params)
+}
+
+// checkSameBitness は読むプロセスとこのツールのビット数が違うときにエラーを返す
+func checkSameBitness(h windows.Handle) error {
+	var self, target int32
+	if r, _, err := procIsWow64Process.Call(uintptr(windows.CurrentProcess()), uintptr(unsafe.Pointer(&self))); r == 0 {
+		return err
+	}
+	if r, _, err := procIsWow64Process.Call(uintptr(h), uintptr(unsafe.Pointer(&target))); r == 0 {
+		return err
+	}
+	if self != target {
+		return errors.New("the process has a different bitness from this tool")
+	}
+	return nil
+}
+
+func readProcess(h windows.Handle, addr uintptr, dst unsafe.Pointer, size uintptr) error {
+	var read uintptr
+	r, _, err := procReadProcessMemory.Call(uintptr(h), addr, uintptr(dst), size, uintptr(unsafe.Pointer(&read)))
+	if r == 0 {
+		return err
+	}
+	if read != size {
+		return fmt.Errorf("read %d bytes of %d", read, size)
+	}
+	return nil
+}
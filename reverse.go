@@ -0,0 +1,89 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"io"
+	"time"
+)
+
+const reverseChunkSize = 64 * 1024
+
+// scanLinesReverse は r を末尾から chunkSize ずつ読み, 新しい行から順に fn に渡す
+// 最後の改行より後ろは書き込み途中の行なので渡さない. fn が false を返したところで読むのをやめる
+func scanLinesReverse(r io.ReaderAt, size int64, chunkSize int, fn func(line string) bool) error {
+	buf := make([]byte, chunkSize)
+	// carry は後ろのチャンクから持ち越した, 行の途中から始まる部分
+	var carry []byte
+	// partial は最後の改行をまだ見つけていない間 true
+	partial := true
+
+	for end := size; end > 0; {
+		start := end - int64(chunkSize)
+		if start < 0 {
+			start = 0
+		}
+		n := int(end - start)
+		if _, err := r.ReadAt(buf[:n], start); err != nil && err != io.EOF {
+			return err
+		}
+		chunk := append(buf[:n:n], carry...)
+
+		for {
+			i := bytes.LastIndexByte(chunk, '\n')
+			if i < 0 {
+				break
+			}
+			if partial {
+				partial = false
+			} else if !fn(string(bytes.TrimSuffix(chunk[i+1:], []byte("\r")))) {
+				return nil
+			}
+			chunk = chunk[:i]
+		}
+		carry = append([]byte{}, chunk...)
+		end = start
+	}
+
+	if len(carry) > 0 && !partial {
+		fn(string(bytes.TrimSuffix(carry, []byte("\r"))))
+	}
+	return nil
+}
+
+// completeLinesSize は r の最後の改行までの大きさを返す. 改行より後ろの書き込み途中の行は次に読む
+func completeLinesSize(r io.ReaderAt, size int64, chunkSize int) (int64, error) {
+	buf := make([]byte, chunkSize)
+	for end := size; end > 0; {
+		start := end - int64(chunkSize)
+		if start < 0 {
+			start = 0
+		}
+		n := int(end - start)
+		if _, err := r.ReadAt(buf[:n], start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// parseLatestInstanceReverse は r を末尾から読み, 最後に読めたインスタンスを返す
+func parseLatestInstanceReverse(r io.ReaderAt, size int64, chunkSize int, patterns *PatternRegistry, loc *time.Location) (Instance, error) {
+	latestInstance := Instance{}
+	err := scanLinesReverse(r, size, chunkSize, func(line string) bool {
+		if line == "" {
+			return true
+		}
+		// 書き込み途中や壊れた行は読み飛ばして, その前のインスタンスを使う
+		instance, err := patterns.Instance(line, loc)
+		if err != nil {
+			return true
+		}
+		latestInstance = instance
+		return false
+	})
+	return latestInstance, err
+}
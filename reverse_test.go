@@ -0,0 +1,162 @@
+package vrcarjt
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanLinesReverse(t *testing.T) {
+	content := "a\r\nbb\n\nccc\r\nd"
+	for _, chunk := range []int{1, 2, 3, 5, 64} {
+		var got []string
+		err := scanLinesReverse(strings.NewReader(content), int64(len(content)), chunk, func(line string) bool {
+			got = append(got, line)
+			return true
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 改行で終わっていない d は書き込み途中の行なので渡さない
+		expect := []string{"ccc", "", "bb", "a"}
+		if !reflect.DeepEqual(got, expect) {
+			t.Errorf("chunk %d doesnt match \nexpect %q \ngot %q", chunk, expect, got)
+		}
+	}
+}
+
+func TestCompleteLinesSize(t *testing.T) {
+	tests := []struct {
+		content string
+		expect  int64
+	}{
+		{"", 0},
+		{"partial", 0},
+		{"a\nbb\n", 5},
+		{"a\nbb\nwrld_cc124ed6-acec-4d55", 5},
+	}
+	for _, test := range tests {
+		for _, chunk := range []int{1, 2, 64} {
+			got, err := completeLinesSize(strings.NewReader(test.content), int64(len(test.content)), chunk)
+			if err != nil || got != test.expect {
+				t.Errorf("%q chunk %d expect %d got %d %v", test.content, chunk, test.expect, got, err)
+			}
+		}
+	}
+}
+
+func TestParseLatestInstanceReverseSkipsPartialLine(t *testing.T) {
+	content := "2021.02.14 01:00:00 Log        -  [Behaviour] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)\n" +
+		"2021.02.14 02:00:00 Log        -  [Behaviour] Destination set: wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:999"
+	got, err := parseLatestInstanceReverse(strings.NewReader(content), int64(len(content)), 16, defaultPatterns, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"; got.ID != expect {
+		t.Errorf("expect %v got %v", expect, got.ID)
+	}
+}
+
+func TestParseLatestInstanceReverse(t *testing.T) {
+	files, err := filepath.Glob(".test_data/*.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := NewVRCAutoRejoinTool()
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := v.parseLatestInstance(string(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, chunk := range []int{1, 7, 100, reverseChunkSize} {
+			got, err := parseLatestInstanceReverse(bytes.NewReader(content), int64(len(content)), chunk, defaultPatterns, time.Local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != expect {
+				t.Errorf("%s chunk %d doesnt match \nexpect %v \ngot %v", file, chunk, expect, got)
+			}
+		}
+
+		got, err := v.ParseLatestInstance(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expect {
+			t.Errorf("%s doesnt match \nexpect %v \ngot %v", file, expect, got)
+		}
+	}
+}
+
+const benchmarkLogSize = 500 * 1024 * 1024
+
+// writeBenchmarkLog は先頭と末尾近くに Destination set のある 500MB のログを作る
+func writeBenchmarkLog(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	fmt.Fprint(w, "2021.02.14 22:00:00 Log        -  [Behaviour] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d\r\n\r\n")
+	written := 0
+	for i := 0; written < benchmarkLogSize; i++ {
+		n, _ := fmt.Fprintf(w, "2021.02.14 23:%02d:%02d Log        -  [Network Processing] RPC invoked SendRPC on VRC_EventHandler for %d\r\n\r\n", i/60%60, i%60, i)
+		written += n
+		if written > benchmarkLogSize-1024*1024 && written-n <= benchmarkLogSize-1024*1024 {
+			fmt.Fprint(w, "2021.02.15 05:00:00 Log        -  [Behaviour] Destination set: wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)\r\n\r\n")
+		}
+	}
+	return w.Flush()
+}
+
+func BenchmarkParseLatestInstance(b *testing.B) {
+	dir, err := ioutil.TempDir("", "vrcarjt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "output_log_22-00-00.txt")
+	if err := writeBenchmarkLog(path); err != nil {
+		b.Fatal(err)
+	}
+	v := NewVRCAutoRejoinTool()
+	expect := "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)"
+
+	b.Run("reverse", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			got, err := v.ParseLatestInstance(path)
+			if err != nil || got.ID != expect {
+				b.Fatal(got, err)
+			}
+		}
+	})
+
+	b.Run("read all", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			got, err := v.parseLatestInstance(string(content))
+			if err != nil || got.ID != expect {
+				b.Fatal(got, err)
+			}
+		}
+	})
+}
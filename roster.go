@@ -0,0 +1,215 @@
+package vrcarjt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// localUserSearchLimit はログの先頭から自分の表示名を探す範囲
+const localUserSearchLimit = 4 * 1024 * 1024
+
+// roster は今いるインスタンスにいるプレイヤーをログから追う
+// インスタンスを出たときは出る前のプレイヤーを previous に残し, 戻るかを判断するときに使う
+// leaving は OnLeftRoom から次の移動先が決まるまでの間を表す
+type roster struct {
+	lock      *sync.Mutex
+	patterns  *PatternRegistry
+	localUser string
+	// localUserID は自分のユーザー ID. 新しいインスタンスを作るときの持ち主に使う
+	localUserID string
+
+	instance string
+	players  map[string]bool
+	leaving  bool
+
+	previousInstance string
+	previous         []string
+}
+
+func newRoster(patterns *PatternRegistry) *roster {
+	return &roster{lock: &sync.Mutex{}, patterns: patterns, players: map[string]bool{}}
+}
+
+// rosterChange はログの 1 行で変わったプレイヤー
+type rosterChange struct {
+	Event LogEvent
+	Name  string
+}
+
+// observe はプレイヤーの出入りのログを読んで名簿を更新する
+func (r *roster) observe(line string) (rosterChange, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if groups, ok := r.patterns.Match(EventAuthenticated, line); ok {
+		r.localUser = strings.TrimSpace(groups["name"])
+		r.localUserID = groups["user"]
+		return rosterChange{Event: EventAuthenticated, Name: r.localUser}, true
+	}
+	if groups, ok := r.patterns.Match(EventDestination, line); ok {
+		if !r.leaving {
+			r.snapshot()
+		}
+		r.instance = strings.TrimRight(strings.TrimSpace(groups["instance"]), "\x00")
+		r.players = map[string]bool{}
+		r.leaving = false
+		return rosterChange{}, false
+	}
+	if _, ok := r.patterns.Match(EventLeftRoom, line); ok {
+		r.snapshot()
+		r.leaving = true
+		return rosterChange{}, false
+	}
+	// 出る途中の出入りは全員が抜けるだけなので出る前の名簿を残す
+	if r.leaving {
+		return rosterChange{}, false
+	}
+	if groups, ok := r.patterns.Match(EventPlayerJoined, line); ok {
+		name := strings.TrimSpace(groups["name"])
+		r.players[name] = true
+		return rosterChange{Event: EventPlayerJoined, Name: name}, true
+	}
+	if groups, ok := r.patterns.Match(EventPlayerLeft, line); ok {
+		name := strings.TrimSpace(groups["name"])
+		delete(r.players, name)
+		return rosterChange{Event: EventPlayerLeft, Name: name}, true
+	}
+	return rosterChange{}, false
+}
+
+func (r *roster) snapshot() {
+	if r.instance == "" {
+		return
+	}
+	r.previousInstance = r.instance
+	r.previous = r.others()
+}
+
+// others は自分以外のプレイヤーを名前の順に返す
+func (r *roster) others() []string {
+	players := []string{}
+	for name := range r.players {
+		if name != r.localUser {
+			players = append(players, name)
+		}
+	}
+	sort.Strings(players)
+	return players
+}
+
+// current は今いるインスタンスと自分以外のプレイヤーを返す
+func (r *roster) current() (string, []string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.instance, r.others()
+}
+
+func (r *roster) user() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.localUser
+}
+
+func (r *roster) userID() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.localUserID
+}
+
+// playersIn は instance にいた自分以外のプレイヤーを返す. instance の名簿がわからないときは false を返す
+// 出る途中のときは出る前の名簿を使う
+func (r *roster) playersIn(instance string) ([]string, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.leaving && r.previousInstance != "" && SameInstance(r.previousInstance, instance) {
+		return r.previous, true
+	}
+	if r.instance != "" && SameInstance(r.instance, instance) {
+		return r.others(), true
+	}
+	if r.previousInstance != "" && SameInstance(r.previousInstance, instance) {
+		return r.previous, true
+	}
+	return nil, false
+}
+
+// rebuild はログの先頭から自分の表示名を, 最後の移動先からプレイヤーの出入りを読み直す
+// 立ち上げ直した VRChat のログを読むときも前のインスタンスの名簿は残す
+func (r *roster) rebuild(path string) error {
+	r.lock.Lock()
+	r.instance, r.players, r.leaving = "", map[string]bool{}, false
+	r.lock.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(io.LimitReader(f, localUserSearchLimit))
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		if _, ok := r.patterns.Match(EventAuthenticated, s.Text()); ok {
+			r.observe(s.Text())
+			break
+		}
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// 最後の移動先までを末尾から集めて, 古い順に読み直す
+	var lines []string
+	err = scanLinesReverse(f, stat.Size(), reverseChunkSize, func(line string) bool {
+		if _, ok := r.patterns.Match(EventDestination, line); ok {
+			lines = append(lines, line)
+			return false
+		}
+		for _, e := range []LogEvent{EventPlayerJoined, EventPlayerLeft, EventLeftRoom} {
+			if _, ok := r.patterns.Match(e, line); ok {
+				lines = append(lines, line)
+				break
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(lines) - 1; i >= 0; i-- {
+		r.observe(lines[i])
+	}
+	return nil
+}
+
+// countFriends は players のうち friends に含まれる人数を返す
+func countFriends(players []string, friends []string) int {
+	n := 0
+	for _, p := range players {
+		if containsFold(friends, p) {
+			n++
+		}
+	}
+	return n
+}
+
+// observeRoster は名簿を更新してプレイヤーの出入りをイベントに記録する
+func (v *VRCAutoRejoinTool) observeRoster(line string) {
+	change, ok := v.roster.observe(line)
+	if !ok {
+		return
+	}
+	instance, players := v.roster.current()
+	switch change.Event {
+	case EventPlayerJoined:
+		v.record(EventPlayerJoin, instance, fmt.Sprintf("%s joined (%d players)", change.Name, len(players)))
+	case EventPlayerLeft:
+		v.record(EventPlayerLeave, instance, fmt.Sprintf("%s left (%d players)", change.Name, len(players)))
+	}
+}
@@ -0,0 +1,122 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	rosterStart = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)~nonce(86CB2A7F4E4AC916)"
+	rosterHome  = "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:99999~region(jp)"
+)
+
+func TestRoster(t *testing.T) {
+	content, err := ioutil.ReadFile(filepath.Join(".test_data", "roster.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.ReplaceAll(string(content), "\r", ""), "\n")
+
+	r := newRoster(defaultPatterns)
+	var leftAt, movedAt int
+	for n, line := range lines {
+		r.observe(line)
+		if strings.Contains(line, "OnLeftRoom") {
+			leftAt = n
+		}
+		if strings.Contains(line, rosterHome) {
+			movedAt = n
+		}
+	}
+	if r.user() != "bootjp" {
+		t.Errorf("expect local user bootjp got %q", r.user())
+	}
+	instance, players := r.current()
+	if instance != rosterHome || len(players) != 0 {
+		t.Errorf("expect alone in %s got %v in %s", rosterHome, players, instance)
+	}
+	got, ok := r.playersIn(rosterStart)
+	if !ok || !reflect.DeepEqual(got, []string{"alice", "carol"}) {
+		t.Errorf("expect players before leaving got %v %v", got, ok)
+	}
+	if _, ok := r.playersIn("wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710"); ok {
+		t.Error("expect unknown instance")
+	}
+
+	// 出る途中と移動先が決まった直後でも出る前の名簿を返す
+	for _, until := range []int{leftAt + 3, movedAt} {
+		r := newRoster(defaultPatterns)
+		for _, line := range lines[:until+1] {
+			r.observe(line)
+		}
+		got, ok := r.playersIn(rosterStart)
+		if !ok || !reflect.DeepEqual(got, []string{"alice", "carol"}) {
+			t.Errorf("line %d: expect players before leaving got %v %v", until, got, ok)
+		}
+	}
+}
+
+func TestRosterRebuild(t *testing.T) {
+	r := newRoster(defaultPatterns)
+	if err := r.rebuild(filepath.Join(".test_data", "roster.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if r.user() != "bootjp" {
+		t.Errorf("expect local user bootjp got %q", r.user())
+	}
+	// 最後の移動先より前は読まないので前のインスタンスの名簿はわからない
+	if instance, players := r.current(); instance != rosterHome || len(players) != 0 {
+		t.Errorf("expect alone in %s got %v in %s", rosterHome, players, instance)
+	}
+	if _, ok := r.playersIn(rosterStart); ok {
+		t.Error("expect unknown instance")
+	}
+}
+
+func TestRosterRules(t *testing.T) {
+	zero, one := 0, 1
+	conf := &Setting{
+		Friends: []string{"Alice"},
+		Rules: []Rule{
+			{Name: "alone", When: RuleCondition{MaxPlayers: &zero}, Action: ActionIgnore},
+			{Name: "no friends", When: RuleCondition{MaxFriends: &zero}, Action: ActionNotify},
+			{Name: "friends", When: RuleCondition{MinFriends: &one}, Action: ActionRejoin},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		players []string
+		expect  bool
+	}{
+		{"friend is there", []string{"alice", "bob"}, true},
+		{"no friends", []string{"bob"}, false},
+		{"alone", []string{}, false},
+		{"unknown", nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			v := newVRCAutoRejoinTool(conf)
+			v.playSound = func(string) {}
+			v.clock = &fakeClock{now: time.Date(2021, 2, 14, 12, 0, 0, 0, time.Local)}
+			v.LatestInstance = Instance{ID: rosterStart}
+			if test.players != nil {
+				v.roster.observe("2021.02.14 01:00:00 Log        -  [Behaviour] Destination set: " + rosterStart)
+				for _, p := range test.players {
+					v.observeRoster("2021.02.14 01:00:10 Log        -  [Behaviour] OnPlayerJoined " + p)
+				}
+				v.roster.observe("2021.02.14 04:00:00 Log        -  [Behaviour] Destination set: " + rosterHome)
+			}
+			if got := v.decideRejoin(CauseHome, Instance{ID: rosterHome}); got != test.expect {
+				t.Errorf("expect %v got %v", test.expect, got)
+			}
+			if n := len(v.Events()); n != len(test.players) {
+				t.Errorf("expect %d player events got %d", len(test.players), n)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// RejoinCause is the reason why the tool is going to rejoin
+type RejoinCause string
+
+const (
+	CauseTimeout    RejoinCause = "timeout"
+	CauseDisconnect RejoinCause = "disconnect"
+	CauseHome       RejoinCause = "home"
+	CauseMove       RejoinCause = "move"
+	CauseCrash      RejoinCause = "crash"
+	CauseHang       RejoinCause = "hang"
+	CauseMemory     RejoinCause = "memory"
+	CauseVerify     RejoinCause = "verify"
+	CauseRestore    RejoinCause = "restore"
+	// CauseKick, CauseVoteKick, CauseBan はモデレーションで追い出されたことを表す. rules によらず rejoin しない
+	CauseKick     RejoinCause = "kick"
+	CauseVoteKick RejoinCause = "vote_kick"
+	CauseBan      RejoinCause = "ban"
+	// CauseInstanceFull, CauseInstanceClosed, CauseWorldLoadFailed は rejoin したインスタンスに入れなかった理由
+	CauseInstanceFull    RejoinCause = "instance_full"
+	CauseInstanceClosed  RejoinCause = "instance_closed"
+	CauseWorldLoadFailed RejoinCause = "world_load_failed"
+)
+
+// RuleAction is what the tool does when a rule matches
+type RuleAction string
+
+const (
+	ActionRejoin   RuleAction = "rejoin"
+	ActionIgnore   RuleAction = "ignore"
+	ActionNotify   RuleAction = "notify"
+	ActionDelay    RuleAction = "delay"
+	ActionRetarget RuleAction = "retarget"
+	ActionFallback RuleAction = "fallback"
+)
+
+// Rule は setting.yml の rules に書く rejoin の判断のルール. 上から順に評価して最初に一致したものを使う
+type Rule struct {
+	Name   string        `yaml:"name"`
+	When   RuleCondition `yaml:"when"`
+	Action RuleAction    `yaml:"action"`
+	// DelayMinutes は delay のときに rejoin までに待つ時間
+	DelayMinutes int `yaml:"delay_minutes"`
+	// World は fallback のときに入るインスタンス
+	World string `yaml:"world"`
+}
+
+// RuleCondition はルールの条件. 空の項目は条件にしない
+// worlds, access_types, owners は戻るインスタンスに対する条件
+// min_players, max_players, min_friends, max_friends は戻るインスタンスに残っている自分以外のプレイヤーの人数の条件で, 名簿がわからないときは一致しない
+type RuleCondition struct {
+	Worlds      []string      `yaml:"worlds"`
+	AccessTypes []string      `yaml:"access_types"`
+	Owners      []string      `yaml:"owners"`
+	Hours       string        `yaml:"hours"`
+	Weekdays    []string      `yaml:"weekdays"`
+	Causes      []RejoinCause `yaml:"causes"`
+	MinAttempts int           `yaml:"min_attempts"`
+	MaxAttempts int           `yaml:"max_attempts"`
+	MinPlayers  *int          `yaml:"min_players"`
+	MaxPlayers  *int          `yaml:"max_players"`
+	MinFriends  *int          `yaml:"min_friends"`
+	MaxFriends  *int          `yaml:"max_friends"`
+}
+
+// RuleInput は rejoin するかを判断するときの状況
+type RuleInput struct {
+	Target      string
+	Destination string
+	Cause       RejoinCause
+	Attempts    int
+	Time        time.Time
+	// Players は戻るインスタンスにいた自分以外のプレイヤー, Friends はそのうち friends に含まれる人数
+	Players     []string
+	Friends     int
+	RosterKnown bool
+}
+
+// RuleDecision は評価した結果. どのルールにも一致しないときは Rule が空で rejoin する
+type RuleDecision struct {
+	Rule   string
+	Action RuleAction
+	Delay  time.Duration
+	World  string
+}
+
+type compiledRule struct {
+	Rule
+	hours *timeWindow
+}
+
+// logCauses はログから検出する rejoin の理由. 体操の時間の組み込みルールはこれだけを対象にする
+var logCauses = []RejoinCause{CauseTimeout, CauseDisconnect, CauseHome, CauseMove}
+
+// compileRules は setting.yml のルールを検証する. enable_radio_exercises のときは体操の時間を無視するルールを先頭に加える
+// join_full_retry_minutes のときは満員で入れなかったときに待つルールを最後に加える
+func compileRules(conf *Setting) ([]compiledRule, error) {
+	rules := conf.Rules
+	if conf.EnableRadioExercises {
+		radio := Rule{Name: "radio exercises", When: RuleCondition{Hours: "05:45-08:00", Causes: logCauses}, Action: ActionIgnore}
+		rules = append([]Rule{radio}, rules...)
+	}
+	// 満員のインスタンスにはすぐに入り直さずに待つ. 自分で書いたルールの方を優先する
+	if conf.JoinFullRetryMinutes > 0 {
+		full := Rule{Name: "instance full", When: RuleCondition{Causes: []RejoinCause{CauseInstanceFull}}, Action: ActionDelay, DelayMinutes: conf.JoinFullRetryMinutes}
+		rules = append(append([]Rule{}, rules...), full)
+	}
+
+	compiled := make([]compiledRule, 0, len(rules))
+	for n, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", n+1)
+		}
+		c := compiledRule{Rule: r}
+		switch r.Action {
+		case ActionRejoin, ActionIgnore, ActionNotify, ActionRetarget:
+		case ActionDelay:
+			if r.DelayMinutes <= 0 {
+				return nil, fmt.Errorf("%s: delay_minutes must be positive", r.Name)
+			}
+		case ActionFallback:
+			if _, err := ParseInstanceTarget(r.World); err != nil {
+				return nil, fmt.Errorf("%s: invalid world: %w", r.Name, err)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown action %q", r.Name, r.Action)
+		}
+		if r.When.Hours != "" {
+			w, err := parseTimeWindow(r.When.Hours)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", r.Name, err)
+			}
+			c.hours = w
+		}
+		for _, d := range r.When.Weekdays {
+			if _, ok := parseWeekday(d); !ok {
+				return nil, fmt.Errorf("%s: unknown weekday %q", r.Name, d)
+			}
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) < 3 {
+		return 0, false
+	}
+	d, ok := weekdays[s[:3]]
+	return d, ok
+}
+
+// match は r の条件に in が一致するかを返す. 一致しないときはその理由も返す
+func (r compiledRule) match(in RuleInput) (bool, string) {
+	w := r.When
+	target, _ := ParseInstanceID(in.Target)
+
+	if len(w.Worlds) > 0 && !containsFold(w.Worlds, target.WorldID) {
+		return false, "world " + target.WorldID
+	}
+	if len(w.AccessTypes) > 0 && !containsFold(w.AccessTypes, target.AccessType) {
+		return false, "access type " + target.AccessType
+	}
+	if len(w.Owners) > 0 && !containsFold(w.Owners, target.Owner) {
+		return false, "owner " + target.Owner
+	}
+	if r.hours != nil && !r.hours.contains(in.Time) {
+		return false, "time " + in.Time.Format("15:04")
+	}
+	if len(w.Weekdays) > 0 {
+		found := false
+		for _, d := range w.Weekdays {
+			if wd, _ := parseWeekday(d); wd == in.Time.Weekday() {
+				found = true
+			}
+		}
+		if !found {
+			return false, "weekday " + in.Time.Weekday().String()
+		}
+	}
+	if len(w.Causes) > 0 {
+		found := false
+		for _, c := range w.Causes {
+			if c == in.Cause {
+				found = true
+			}
+		}
+		if !found {
+			return false, "cause " + string(in.Cause)
+		}
+	}
+	if w.MinAttempts > 0 && in.Attempts < w.MinAttempts {
+		return false, fmt.Sprintf("attempts %d", in.Attempts)
+	}
+	if w.MaxAttempts > 0 && in.Attempts > w.MaxAttempts {
+		return false, fmt.Sprintf("attempts %d", in.Attempts)
+	}
+	if w.MinPlayers != nil || w.MaxPlayers != nil || w.MinFriends != nil || w.MaxFriends != nil {
+		if !in.RosterKnown {
+			return false, "players unknown"
+		}
+		if !inRange(len(in.Players), w.MinPlayers, w.MaxPlayers) {
+			return false, fmt.Sprintf("players %d", len(in.Players))
+		}
+		if !inRange(in.Friends, w.MinFriends, w.MaxFriends) {
+			return false, fmt.Sprintf("friends %d", in.Friends)
+		}
+	}
+	return true, ""
+}
+
+func inRange(n int, min *int, max *int) bool {
+	return (min == nil || n >= *min) && (max == nil || n <= *max)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// evaluateRules は上から順にルールを評価して最初に一致したルールの結果を返す
+func evaluateRules(rules []compiledRule, in RuleInput) RuleDecision {
+	for _, r := range rules {
+		if ok, _ := r.match(in); !ok {
+			continue
+		}
+		return RuleDecision{
+			Rule:   r.Name,
+			Action: r.Action,
+			Delay:  time.Duration(r.DelayMinutes) * time.Minute,
+			World:  r.World,
+		}
+	}
+	return RuleDecision{Action: ActionRejoin}
+}
+
+// decideRejoin は rules に従って rejoin するかを決める. rejoin しないときは rejoin 以外の action を実行して false を返す
+func (v *VRCAutoRejoinTool) decideRejoin(cause RejoinCause, destination Instance) bool {
+	target, _ := v.rejoinTarget()
+	if v.refuseRejoin(cause, target, destination) {
+		v.recordHistory(HistoryRecord{Kind: HistoryDisconnect, Instance: target.ID, Cause: cause, Outcome: "refused"})
+		v.incidents.decided(v.clock.Now(), v.Profile, cause, target, destination, RuleDecision{Rule: "moderation", Action: ActionIgnore})
+		return false
+	}
+	players, known := v.roster.playersIn(target.ID)
+	d := evaluateRules(v.rules, RuleInput{
+		Target:      target.ID,
+		Destination: destination.ID,
+		Cause:       cause,
+		Attempts:    v.rejoins,
+		Time:        v.clock.Now().In(time.Local),
+		Players:     players,
+		Friends:     countFriends(players, v.Config.Friends),
+		RosterKnown: known,
+	})
+	if d.Rule != "" {
+		log.Println("rule", d.Rule, "fired:", d.Action, "for", cause)
+	}
+	v.recordHistory(HistoryRecord{Kind: HistoryDisconnect, Instance: target.ID, Cause: cause, Outcome: string(d.Action)})
+	v.incidents.decided(v.clock.Now(), v.Profile, cause, target, destination, d)
+
+	switch d.Action {
+	case ActionIgnore:
+		return false
+	case ActionNotify:
+		v.notify("rule "+d.Rule, fmt.Sprintf("%s detected. target %s", cause, target.ID))
+		return false
+	case ActionRetarget:
+		if destination.ID != "" {
+			v.retarget(destination, "rule "+d.Rule)
+		}
+		return false
+	case ActionDelay:
+		v.clock.Sleep(d.Delay)
+		return v.IsRun()
+	case ActionFallback:
+		id, _ := ParseInstanceTarget(d.World)
+		v.targetLock.Lock()
+		v.ruleTarget = Instance{ID: id}
+		v.targetLock.Unlock()
+	}
+	return true
+}
+
+// ExplainRules は line を検出したときにどのルールが一致するかを w に書き出す
+// players は戻るインスタンスにいた自分以外のプレイヤーで, nil のときは名簿がわからないものとして扱う
+func ExplainRules(w io.Writer, conf *Setting, line string, target string, attempts int, players []string) error {
+	rules, err := compileRules(conf)
+	if err != nil {
+		return err
+	}
+	patterns, err := NewPatternRegistry(conf.LogPatterns)
+	if err != nil {
+		return err
+	}
+	loc, err := logLocation(conf.LogTimezone)
+	if err != nil {
+		return err
+	}
+
+	at, err := parseLogTime(line, loc)
+	if err != nil {
+		return err
+	}
+	in := RuleInput{Target: target, Attempts: attempts, Time: at.In(time.Local)}
+	if players != nil {
+		in.Players, in.Friends, in.RosterKnown = players, countFriends(players, conf.Friends), true
+	}
+	if _, ok := patterns.Match(EventTimeout, line); ok {
+		in.Cause = CauseTimeout
+	} else if i, err := patterns.Instance(line, loc); err == nil {
+		in.Destination = i.ID
+		_, _, in.Cause = newMoveClassifier(patterns, loc, conf.HomeWorld).classify(i)
+	} else {
+		return fmt.Errorf("line is neither a timeout nor a move")
+	}
+	fmt.Fprintf(w, "cause: %s\ntarget: %s\nattempts: %d\ntime: %s\n", in.Cause, in.Target, in.Attempts, in.Time.Format("2006-01-02 15:04 Mon"))
+	if in.RosterKnown {
+		fmt.Fprintf(w, "players: %d (friends %d)\n", len(in.Players), in.Friends)
+	} else {
+		fmt.Fprintln(w, "players: unknown")
+	}
+
+	for _, r := range rules {
+		ok, reason := r.match(in)
+		if !ok {
+			fmt.Fprintf(w, "  %s: not matched (%s)\n", r.Name, reason)
+			continue
+		}
+		fmt.Fprintf(w, "  %s: matched\n", r.Name)
+	}
+
+	d := evaluateRules(rules, in)
+	name := d.Rule
+	if name == "" {
+		name = "(default)"
+	}
+	_, err = fmt.Fprintf(w, "fired: %s -> %s\n", name, d.Action)
+	return err
+}
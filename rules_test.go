@@ -0,0 +1,168 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileRules(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown action", Rule{Action: "jump"}},
+		{"delay without minutes", Rule{Action: ActionDelay}},
+		{"fallback without world", Rule{Action: ActionFallback}},
+		{"invalid hours", Rule{Action: ActionIgnore, When: RuleCondition{Hours: "25:00"}}},
+		{"invalid weekday", Rule{Action: ActionIgnore, When: RuleCondition{Weekdays: []string{"someday"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := compileRules(&Setting{Rules: []Rule{test.rule}}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestInvalidRulesStopRun(t *testing.T) {
+	v := newVRCAutoRejoinTool(&Setting{Rules: []Rule{{Action: "jump"}}})
+	if err := v.Run(); err == nil {
+		t.Fatal("Run must fail with invalid rules")
+	}
+	if v.IsRun() {
+		t.Error("must not be running")
+	}
+}
+
+func TestAttemptsResetAfterRejoin(t *testing.T) {
+	const target = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"
+	v := newVRCAutoRejoinTool(&Setting{Rules: []Rule{{Action: ActionIgnore, When: RuleCondition{MinAttempts: 2}}}})
+	v.clock = &fakeClock{now: time.Date(2021, 2, 14, 1, 0, 0, 0, time.Local)}
+	v.playSound = func(string) {}
+	v.LatestInstance = Instance{ID: target}
+	v.rejoins = 2
+
+	if !v.verifyRejoin(Instance{ID: target}) {
+		t.Fatal("verification must succeed")
+	}
+	if v.rejoins != 0 {
+		t.Fatalf("attempts must be reset after a verified rejoin got %d", v.rejoins)
+	}
+	if !v.decideRejoin(CauseTimeout, Instance{}) {
+		t.Error("min_attempts must not match after a verified rejoin")
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	const friends = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~friends(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~region(jp)"
+	const public = "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"
+	// 2021-02-14 は日曜日
+	sunday := time.Date(2021, 2, 14, 6, 30, 0, 0, time.Local)
+	monday := sunday.Add(24 * time.Hour)
+
+	rules, err := compileRules(&Setting{
+		EnableRadioExercises: true,
+		Rules: []Rule{
+			{Name: "sleep world", When: RuleCondition{Worlds: []string{"wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f"}, Causes: []RejoinCause{CauseCrash}}, Action: ActionNotify},
+			{Name: "friends owner", When: RuleCondition{AccessTypes: []string{"Friends"}, Owners: []string{"usr_d97adcdc-718b-4361-9b75-2c97c0a4993d"}, Weekdays: []string{"monday"}}, Action: ActionDelay, DelayMinutes: 5},
+			{Name: "too many", When: RuleCondition{MinAttempts: 3}, Action: ActionFallback, World: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		in     RuleInput
+		rule   string
+		action RuleAction
+	}{
+		{"radio exercises", RuleInput{Target: public, Cause: CauseTimeout, Time: sunday}, "radio exercises", ActionIgnore},
+		{"radio exercises only for log causes", RuleInput{Target: public, Cause: CauseCrash, Time: sunday}, "sleep world", ActionNotify},
+		{"other cause", RuleInput{Target: public, Cause: CauseHang, Time: sunday}, "", ActionRejoin},
+		{"weekday", RuleInput{Target: friends, Cause: CauseMove, Time: monday.Add(3 * time.Hour)}, "friends owner", ActionDelay},
+		{"not the weekday", RuleInput{Target: friends, Cause: CauseMove, Time: sunday.Add(3 * time.Hour)}, "", ActionRejoin},
+		{"attempts", RuleInput{Target: public, Cause: CauseMove, Attempts: 3, Time: sunday.Add(3 * time.Hour)}, "too many", ActionFallback},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := evaluateRules(rules, test.in)
+			if d.Rule != test.rule || d.Action != test.action {
+				t.Errorf("expect %q %s got %q %s", test.rule, test.action, d.Rule, d.Action)
+			}
+		})
+	}
+}
+
+func TestDecideRejoin(t *testing.T) {
+	const target = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"
+	destination := Instance{ID: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)"}
+
+	tests := []struct {
+		rule   Rule
+		rejoin bool
+		target string
+	}{
+		{Rule{Action: ActionRejoin}, true, target},
+		{Rule{Action: ActionIgnore}, false, target},
+		{Rule{Action: ActionNotify}, false, target},
+		{Rule{Action: ActionRetarget}, false, destination.ID},
+		{Rule{Action: ActionDelay, DelayMinutes: 5}, true, target},
+		{Rule{Action: ActionFallback, World: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"}, true, "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.rule.Action), func(t *testing.T) {
+			c := &fakeClock{now: time.Date(2021, 2, 14, 1, 0, 0, 0, time.Local)}
+			v := newVRCAutoRejoinTool(&Setting{Rules: []Rule{test.rule}})
+			v.clock = c
+			v.running = true
+			v.playSound = func(string) {}
+			v.LatestInstance = Instance{ID: target}
+
+			if got := v.decideRejoin(CauseMove, destination); got != test.rejoin {
+				t.Errorf("rejoin expect %v got %v", test.rejoin, got)
+			}
+			if got, _ := v.rejoinTarget(); got.ID != test.target {
+				t.Errorf("target expect %q got %q", test.target, got.ID)
+			}
+			if test.rule.Action == ActionDelay && !c.now.Equal(time.Date(2021, 2, 14, 1, 5, 0, 0, time.Local)) {
+				t.Errorf("must wait 5 minutes got %v", c.now)
+			}
+		})
+	}
+}
+
+func TestExplainRules(t *testing.T) {
+	conf := &Setting{Rules: []Rule{
+		{Name: "night", When: RuleCondition{Hours: "00:00-05:00"}, Action: ActionIgnore},
+		{Name: "timeouts", When: RuleCondition{Causes: []RejoinCause{CauseTimeout}}, Action: ActionNotify},
+	}}
+
+	var out bytes.Buffer
+	line := `2021.02.14 10:12:48 Error      -  Timeout: Your connection to VRChat timed out.`
+	if err := ExplainRules(&out, conf, line, "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"cause: timeout", "night: not matched (time 10:12)", "timeouts: matched", "fired: timeouts -> notify"} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("output must contain %q\n%s", expect, out.String())
+		}
+	}
+
+	out.Reset()
+	line = `2021.02.14 10:12:48 Log        -  [Behaviour] Destination set: wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710`
+	if err := ExplainRules(&out, conf, line, "", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "fired: (default) -> rejoin") {
+		t.Errorf("unexpected output\n%s", out.String())
+	}
+
+	if err := ExplainRules(&out, conf, `2021.02.14 10:12:48 Log        -  [API] unrelated`, "", 0, nil); err == nil {
+		t.Error("unrelated line must be error")
+	}
+}
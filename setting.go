@@ -3,6 +3,7 @@ package vrcarjt
 import (
 	"io/ioutil"
 	"log"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -16,6 +17,69 @@ type Setting struct {
 	EnableDaemon         bool     `yaml:"enable_daemon"`
 	EnableSleepDetector  bool     `yaml:"enable_sleep_detector"`
 	SleepWorld           []string `yaml:"sleep_world"`
+	// 立ち上げ直すときに元の VRChat から引き継ぐ環境変数. 空のときは env_deny 以外のすべてを引き継ぐ
+	EnvAllow []string `yaml:"env_allow"`
+	EnvDeny  []string `yaml:"env_deny"`
+	// VRChat の output_log があるディレクトリ. 空のときは自動で探す
+	LogDir string `yaml:"log_dir"`
+	// Linux で VRChat を立ち上げ直すときに使う steam コマンド
+	SteamPath string `yaml:"steam_path"`
+	// --profile=N で起動したクライアントごとに上書きする設定
+	Profiles map[int]yaml.MapSlice `yaml:"profiles"`
+	// 状態を返す API の待ち受けアドレス. 空のときは API を起動しない
+	APIListen string `yaml:"api_listen"`
+	// VRChat が固まったとみなすまでの時間. 0 のときは判定しない
+	HangLogSilenceMinutes int     `yaml:"hang_log_silence_minutes"`
+	HangCPUIdleMinutes    int     `yaml:"hang_cpu_idle_minutes"`
+	HangCPUThreshold      float64 `yaml:"hang_cpu_threshold"`
+	// メモリの使用量か起動してからの時間が閾値を超えたときに, restart_allowed_hours の間だけ計画的に再起動する
+	RestartMemoryMB     int     `yaml:"restart_memory_mb"`
+	RestartAfterHours   float64 `yaml:"restart_after_hours"`
+	RestartAllowedHours string  `yaml:"restart_allowed_hours"`
+	// 通知を送る Webhook の URL. 空のときはログに出すだけ
+	NotifyWebhook string           `yaml:"notify_webhook"`
+	CrashLoop     CrashLoopSetting `yaml:"crash_loop"`
+	// 元のインスタンスに戻れなかったときに, 同じワールドの新しいインスタンス, fallback_worlds の順に入り直す
+	// 新しいインスタンスは自分を持ち主にして作る. グループのインスタンスは作れないので fallback_worlds に進む
+	FallbackNewInstance bool     `yaml:"fallback_new_instance"`
+	FallbackWorlds      []string `yaml:"fallback_worlds"`
+	// ログからイベントを検出するパターン. 組み込みのパターンに追加するか, replace: yes で置き換える
+	LogPatterns map[LogEvent]LogPatternSetting `yaml:"log_patterns"`
+	// ログの時刻のタイムゾーン. Asia/Tokyo や +09:00 の形式で指定する. 空のときは OS のタイムゾーンを使う
+	LogTimezone string `yaml:"log_timezone"`
+	// ログの時刻と PC の時計のずれとして許容する秒数
+	LogTimeSkewSeconds int `yaml:"log_time_skew_seconds"`
+	// 戻るインスタンスと rejoin の状態を保存するファイル. 空のときは保存しない
+	StateFile string `yaml:"state_file"`
+	// 保存した状態を引き継ぐ期限. 0 のときは期限なし
+	StateMaxAgeMinutes int `yaml:"state_max_age_minutes"`
+	// 名前を付けて保存したインスタンス. GUI, CLI, API から戻るインスタンスとして選べる
+	Bookmarks []Bookmark `yaml:"bookmarks"`
+	// ホームワールドの ID. ここに戻されたときは自分で移動したことがわかるログがなければ戻る
+	HomeWorld string `yaml:"home_world"`
+	// 自分で移動したインスタンスにこの時間いたら戻るインスタンスにする. 0 のときはすぐに戻るインスタンスにする
+	FollowLatestMinutes int `yaml:"follow_latest_minutes"`
+	// rejoin したインスタンスが満員で入れなかったときに入り直すまで待つ時間. 0 のときは待たない
+	JoinFullRetryMinutes int `yaml:"join_full_retry_minutes"`
+	// 訪れたインスタンスと rejoin の履歴を保存するディレクトリ. 空のときは保存しない
+	HistoryDir string `yaml:"history_dir"`
+	// 履歴を残す日数と合計の上限. 0 のときは制限しない
+	HistoryRetentionDays int `yaml:"history_retention_days"`
+	HistoryMaxMB         int `yaml:"history_max_mb"`
+	// 切断や rejoin の記録を保存するディレクトリ. 空のときは保存しない
+	IncidentDir string `yaml:"incident_dir"`
+	// 記録に残す検出したログの前後の行数
+	IncidentContextLines int `yaml:"incident_context_lines"`
+	// 記録のユーザー ID, グループ ID, nonce を伏せる
+	IncidentRedact bool `yaml:"incident_redact"`
+	// Stop したときの summary を保存するディレクトリ. 空のときは保存しない
+	SummaryDir string `yaml:"summary_dir"`
+	// Stop したときの summary を notify_webhook にも送る
+	SummaryNotify bool `yaml:"summary_notify"`
+	// フレンドの表示名. rules の min_friends, max_friends で使う
+	Friends []string `yaml:"friends"`
+	// rejoin するかを決めるルール. 上から順に評価して最初に一致したルールの action を使う
+	Rules []Rule `yaml:"rules"`
 }
 
 var defaultSetting = &Setting{
@@ -25,6 +89,18 @@ var defaultSetting = &Setting{
 	EnableRejoinNotice:   true,
 	EnableDaemon:         false,
 	EnableSleepDetector:  false,
+	SteamPath:            "steam",
+	HangCPUThreshold:     1.0,
+	LogTimeSkewSeconds:   int(defaultLogTimeSkew / time.Second),
+	StateFile:            "state.json",
+	StateMaxAgeMinutes:   60,
+	JoinFullRetryMinutes: 5,
+	HistoryDir:           "history",
+	HistoryRetentionDays: 90,
+	HistoryMaxMB:         20,
+	IncidentDir:          "incidents",
+	IncidentContextLines: 20,
+	SummaryDir:           "summaries",
 }
 
 func LoadConf(path string) *Setting {
@@ -35,7 +111,20 @@ func LoadConf(path string) *Setting {
 		return defaultSetting
 	}
 
-	t := Setting{}
+	t := Setting{
+		SteamPath:            defaultSetting.SteamPath,
+		HangCPUThreshold:     defaultSetting.HangCPUThreshold,
+		LogTimeSkewSeconds:   defaultSetting.LogTimeSkewSeconds,
+		StateFile:            defaultSetting.StateFile,
+		StateMaxAgeMinutes:   defaultSetting.StateMaxAgeMinutes,
+		JoinFullRetryMinutes: defaultSetting.JoinFullRetryMinutes,
+		HistoryDir:           defaultSetting.HistoryDir,
+		HistoryRetentionDays: defaultSetting.HistoryRetentionDays,
+		HistoryMaxMB:         defaultSetting.HistoryMaxMB,
+		IncidentDir:          defaultSetting.IncidentDir,
+		IncidentContextLines: defaultSetting.IncidentContextLines,
+		SummaryDir:           defaultSetting.SummaryDir,
+	}
 	err = yaml.Unmarshal(file, &t)
 	if err != nil {
 		log.Println("invalid config yml fallback to default setting")
@@ -45,3 +134,25 @@ func LoadConf(path string) *Setting {
 	}
 	return &t
 }
+
+// ForProfile は profiles に書かれたクライアントごとの設定で上書きした Setting を返す
+func (s *Setting) ForProfile(profile int) *Setting {
+	t := *s
+	t.Profiles = nil
+
+	override, ok := s.Profiles[profile]
+	if !ok {
+		return &t
+	}
+
+	b, err := yaml.Marshal(override)
+	if err != nil {
+		log.Println(err)
+		return &t
+	}
+	if err := yaml.Unmarshal(b, &t); err != nil {
+		log.Println(err)
+	}
+	t.Profiles = nil
+	return &t
+}
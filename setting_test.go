@@ -0,0 +1,22 @@
+package vrcarjt
+
+import (
+	"testing"
+)
+
+func TestLoadConfShippedSetting(t *testing.T) {
+	// 同梱の setting.yml でコメントになっている項目は既定値になる
+	conf := LoadConf("setting.yml")
+	if conf.JoinFullRetryMinutes != defaultSetting.JoinFullRetryMinutes {
+		t.Errorf("join_full_retry_minutes expect %d got %d", defaultSetting.JoinFullRetryMinutes, conf.JoinFullRetryMinutes)
+	}
+	if conf.HistoryDir != defaultSetting.HistoryDir || conf.HistoryRetentionDays != defaultSetting.HistoryRetentionDays || conf.HistoryMaxMB != defaultSetting.HistoryMaxMB {
+		t.Errorf("history settings must be the defaults got %q %d %d", conf.HistoryDir, conf.HistoryRetentionDays, conf.HistoryMaxMB)
+	}
+	if conf.IncidentDir != defaultSetting.IncidentDir || conf.IncidentContextLines != defaultSetting.IncidentContextLines {
+		t.Errorf("incident settings must be the defaults got %q %d", conf.IncidentDir, conf.IncidentContextLines)
+	}
+	if conf.SummaryDir != defaultSetting.SummaryDir {
+		t.Errorf("summary_dir expect %q got %q", defaultSetting.SummaryDir, conf.SummaryDir)
+	}
+}
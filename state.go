@@ -0,0 +1,139 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// toolState はツールを立ち上げ直しても戻るインスタンスを忘れないように保存する状態
+type toolState struct {
+	Target         string         `json:"target"`
+	TargetTime     time.Time      `json:"target_time"`
+	Armed          bool           `json:"armed"`
+	Pinned         bool           `json:"pinned"`
+	CrashLoop      crashLoopState `json:"crash_loop"`
+	FallbackStep   int            `json:"fallback_step"`
+	FallbackTarget string         `json:"fallback_target,omitempty"`
+	Verifying      bool           `json:"verifying"`
+	// Rejoins は今の切断で rejoin した回数, RuleTarget は rules の fallback で選んだインスタンス
+	Rejoins    int    `json:"rejoins"`
+	RuleTarget string `json:"rule_target,omitempty"`
+	// Blocked はキックや BAN で戻らないことにしたインスタンス. 監視を止めていても引き継ぐ
+	Blocked []blockedTarget `json:"blocked,omitempty"`
+	SavedAt time.Time       `json:"saved_at"`
+}
+
+// statePath は profile ごとの状態ファイルのパスを返す. state.json は profile 1 では state.profile1.json になる
+func statePath(file string, profile int) string {
+	if file == "" || profile == 0 {
+		return file
+	}
+	ext := filepath.Ext(file)
+	return fmt.Sprintf("%s.profile%d%s", strings.TrimSuffix(file, ext), profile, ext)
+}
+
+// saveState は今の状態を状態ファイルに書き出す. armed はツールが監視を続けるつもりかを表す
+func (v *VRCAutoRejoinTool) saveState(armed bool) {
+	path := statePath(v.Config.StateFile, v.Profile)
+	if path == "" {
+		return
+	}
+
+	crashLoop := v.crashLoop.snapshot()
+	v.targetLock.Lock()
+	s := toolState{
+		Target:         v.LatestInstance.ID,
+		TargetTime:     v.LatestInstance.Time,
+		Armed:          armed,
+		Pinned:         v.pinned.ID != "",
+		CrashLoop:      crashLoop,
+		FallbackStep:   v.fallbackStep,
+		FallbackTarget: v.fallbackTarget.ID,
+		Verifying:      v.verifying,
+		Rejoins:        v.rejoins,
+		RuleTarget:     v.ruleTarget.ID,
+		Blocked:        append([]blockedTarget{}, v.blocked...),
+		SavedAt:        v.clock.Now(),
+	}
+	v.targetLock.Unlock()
+	if err := writeState(path, s); err != nil {
+		log.Println("failed to save state:", err)
+	}
+}
+
+// writeState は書き込み途中で落ちても壊れないように一時ファイルに書いてから置き換える
+func writeState(path string, s toolState) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadState は保存された状態を読む. 状態ファイルがないときや state_max_age_minutes より古いときは false を返す
+func (v *VRCAutoRejoinTool) loadState() (toolState, bool) {
+	path := statePath(v.Config.StateFile, v.Profile)
+	if path == "" {
+		return toolState{}, false
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return toolState{}, false
+	}
+	if err != nil {
+		log.Println("failed to load state:", err)
+		return toolState{}, false
+	}
+	var s toolState
+	if err := json.Unmarshal(b, &s); err != nil {
+		log.Println("failed to load state:", err)
+		return toolState{}, false
+	}
+
+	maxAge := time.Duration(v.Config.StateMaxAgeMinutes) * time.Minute
+	if maxAge > 0 && v.clock.Now().Sub(s.SavedAt) > maxAge {
+		log.Println("saved state is expired. saved at", s.SavedAt.Format(TimeFormat))
+		return toolState{}, false
+	}
+	return s, true
+}
+
+// restoreState は監視中に保存された状態があれば戻るインスタンスと rejoin の状態を引き継ぐ
+func (v *VRCAutoRejoinTool) restoreState() bool {
+	s, ok := v.loadState()
+	if ok {
+		v.targetLock.Lock()
+		v.blocked = activeBlocks(s.Blocked, v.clock.Now())
+		v.targetLock.Unlock()
+	}
+	if !ok || !s.Armed || s.Target == "" {
+		return false
+	}
+
+	v.crashLoop.restore(s.CrashLoop)
+	v.launch = v.crashLoop.currentProfile()
+	v.verifying = s.Verifying
+	v.rejoins = s.Rejoins
+
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	v.LatestInstance = Instance{ID: s.Target, Time: s.TargetTime}
+	if s.Pinned && v.pinned.ID == "" {
+		v.pinned = v.LatestInstance
+	}
+	v.fallbackStep = s.FallbackStep
+	v.fallbackTarget = Instance{ID: s.FallbackTarget}
+	v.ruleTarget = Instance{ID: s.RuleTarget}
+	return true
+}
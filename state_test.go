@@ -0,0 +1,115 @@
+package vrcarjt
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatePath(t *testing.T) {
+	tests := []struct {
+		file    string
+		profile int
+		expect  string
+	}{
+		{"state.json", 0, "state.json"},
+		{"state.json", 1, "state.profile1.json"},
+		{filepath.Join("data", "state"), 2, filepath.Join("data", "state.profile2")},
+		{"", 1, ""},
+	}
+	for _, test := range tests {
+		if got := statePath(test.file, test.profile); got != test.expect {
+			t.Errorf("statePath(%q, %d) expect %q got %q", test.file, test.profile, test.expect, got)
+		}
+	}
+}
+
+func TestPersistentState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrcarjt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := &fakeClock{now: time.Date(2021, 2, 14, 2, 0, 0, 0, time.UTC)}
+	conf := &Setting{
+		StateFile:          filepath.Join(dir, "state.json"),
+		StateMaxAgeMinutes: 60,
+		CrashLoop: CrashLoopSetting{
+			MaxRejoins:    1,
+			WindowMinutes: 30,
+			Fallbacks:     []LaunchProfile{{Name: "no-vr", AddArgs: []string{"--no-vr"}}},
+		},
+	}
+	newTool := func() *VRCAutoRejoinTool {
+		v := newVRCAutoRejoinTool(conf)
+		v.clock = c
+		v.crashLoop = newCrashLoopBreaker(c, conf.CrashLoop)
+		return v
+	}
+	target := Instance{ID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)", Time: c.now.Add(-time.Hour)}
+
+	v := newTool()
+	v.LatestInstance = target
+	v.crashLoop.failed()
+	v.crashLoop.attempt()
+	v.crashLoop.failed()
+	v.rejoins = 3
+	v.ruleTarget = Instance{ID: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b"}
+	kicked := blockedTarget{ID: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~region(jp)", Cause: CauseKick, Until: c.now.Add(time.Hour)}
+	v.blocked = []blockedTarget{kicked}
+	v.saveState(true)
+
+	t.Run("restore", func(t *testing.T) {
+		r := newTool()
+		if !r.restoreState() {
+			t.Fatal("state must be restored")
+		}
+		if r.LatestInstance.ID != target.ID || !r.LatestInstance.Time.Equal(target.Time) {
+			t.Errorf("expect %v got %v", target, r.LatestInstance)
+		}
+		if r.launch.Name != "no-vr" {
+			t.Errorf("expect fallback launch profile got %q", r.launch.Name)
+		}
+		if s := r.crashLoop.status(); s.Attempts != 1 || s.Fallback != "no-vr" {
+			t.Errorf("unexpected crash loop status %+v", s)
+		}
+		if r.rejoins != 3 || r.ruleTarget.ID != "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b" {
+			t.Errorf("rejoin attempts and rule target must be restored %d %v", r.rejoins, r.ruleTarget)
+		}
+		if !reflect.DeepEqual(r.blocked, []blockedTarget{kicked}) {
+			t.Errorf("blocked instances must be restored %v", r.blocked)
+		}
+	})
+
+	t.Run("another profile", func(t *testing.T) {
+		r := newTool()
+		r.Profile = 1
+		if r.restoreState() {
+			t.Error("state of profile 0 must not be restored for profile 1")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c.Sleep(61 * time.Minute)
+		defer func() { c.now = c.now.Add(-61 * time.Minute) }()
+		if newTool().restoreState() {
+			t.Error("expired state must not be restored")
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		// Stop と同じく監視をやめた状態を保存する
+		v.saveState(false)
+		r := newTool()
+		if r.restoreState() {
+			t.Error("state must not be restored after stop")
+		}
+		if !r.refuseRejoin(CauseTimeout, Instance{ID: kicked.ID}, Instance{}) {
+			t.Error("kicked instance must be refused after stop")
+		}
+	})
+}
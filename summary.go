@@ -0,0 +1,277 @@
+package vrcarjt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionSummary is a summary of a monitoring session from Start to Stop
+type SessionSummary struct {
+	Profile int       `json:"profile"`
+	Started time.Time `json:"started"`
+	Ended   time.Time `json:"ended"`
+	Target  string    `json:"target,omitempty"`
+	// TimeInTargetSeconds は戻るインスタンスにいた時間, TimeLostSeconds は切断されてから戻るまでに他のインスタンスにいた時間
+	TimeInTargetSeconds int64               `json:"time_in_target_seconds"`
+	TimeLostSeconds     int64               `json:"time_lost_seconds"`
+	Disconnects         int                 `json:"disconnects"`
+	Causes              map[RejoinCause]int `json:"causes"`
+	Rejoins             int                 `json:"rejoins"`
+	RejoinsSucceeded    int                 `json:"rejoins_succeeded"`
+}
+
+// SuccessRate は入り直せた割合を返す. 入れたかを確かめた rejoin がないときは false を返す
+func (s SessionSummary) SuccessRate() (float64, bool) {
+	if s.Rejoins == 0 {
+		return 0, false
+	}
+	return float64(s.RejoinsSucceeded) / float64(s.Rejoins), true
+}
+
+// sessionLog は Start してからの履歴を summary のために覚えておく. history_dir が空でも summary を作れるようにする
+type sessionLog struct {
+	lock    *sync.Mutex
+	started time.Time
+	records []HistoryRecord
+}
+
+func newSessionLog() *sessionLog {
+	return &sessionLog{lock: &sync.Mutex{}}
+}
+
+func (s *sessionLog) start(at time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.started = at
+	s.records = nil
+}
+
+func (s *sessionLog) add(r HistoryRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.started.IsZero() {
+		return
+	}
+	s.records = append(s.records, r)
+}
+
+func (s *sessionLog) snapshot() (time.Time, []HistoryRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.started, append([]HistoryRecord{}, s.records...)
+}
+
+// finish は snapshot を返して記録を終える. 同じ監視の summary を 2 回作らないようにする
+func (s *sessionLog) finish() (time.Time, []HistoryRecord) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	started, records := s.started, s.records
+	s.started = time.Time{}
+	s.records = nil
+	return started, records
+}
+
+// summarizeSession は started から ended までの履歴 records をまとめる
+// 戻るインスタンスは切断や rejoin の記録にあるインスタンスと target とする
+func summarizeSession(profile int, started time.Time, ended time.Time, target string, records []HistoryRecord) SessionSummary {
+	s := SessionSummary{Profile: profile, Started: started, Ended: ended, Target: target, Causes: map[RejoinCause]int{}}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	targets := []string{}
+	if target != "" {
+		targets = append(targets, target)
+	}
+	for _, r := range records {
+		if (r.Kind == HistoryDisconnect || r.Kind == HistoryRejoin) && r.Instance != "" {
+			targets = append(targets, r.Instance)
+		}
+	}
+	isTarget := func(id string) bool {
+		for _, t := range targets {
+			if SameInstance(id, t) {
+				return true
+			}
+		}
+		return false
+	}
+	clip := func(t time.Time) time.Time {
+		if t.Before(started) {
+			return started
+		}
+		if t.After(ended) {
+			return ended
+		}
+		return t
+	}
+
+	var (
+		visit     string
+		entered   time.Time
+		lostSince time.Time
+	)
+	leave := func(at time.Time) {
+		if visit != "" && isTarget(visit) {
+			s.TimeInTargetSeconds += int64(clip(at).Sub(clip(entered)) / time.Second)
+		}
+		visit = ""
+	}
+	for _, r := range records {
+		switch r.Kind {
+		case HistoryEnter:
+			leave(r.Time)
+			visit, entered = r.Instance, r.Time
+			if !lostSince.IsZero() && isTarget(r.Instance) {
+				s.TimeLostSeconds += int64(clip(r.Time).Sub(clip(lostSince)) / time.Second)
+				lostSince = time.Time{}
+			}
+		case HistoryExit:
+			leave(r.Time)
+		case HistoryDisconnect:
+			s.Disconnects++
+			s.Causes[r.Cause]++
+			// 戻らないと決めた切断はその後の時間を失った時間に数えない
+			if lostSince.IsZero() && goesBack(r.Outcome) {
+				lostSince = r.Time
+			}
+		case HistoryRejoin:
+			s.Rejoins++
+			if r.Outcome == "joined" {
+				s.RejoinsSucceeded++
+			}
+		}
+	}
+	leave(ended)
+	if !lostSince.IsZero() {
+		s.TimeLostSeconds += int64(ended.Sub(clip(lostSince)) / time.Second)
+	}
+	return s
+}
+
+// goesBack は切断の記録の outcome が戻るインスタンスに戻ろうとしたものかを返す
+func goesBack(outcome string) bool {
+	switch RuleAction(outcome) {
+	case ActionRejoin, ActionDelay, ActionFallback:
+		return true
+	}
+	return false
+}
+
+// WriteSummary は summary を format (text, json) で w に書き出す
+func WriteSummary(w io.Writer, s SessionSummary, format string) error {
+	switch format {
+	case "", "text":
+		_, err := io.WriteString(w, summaryText(s))
+		return err
+	case "json":
+		return json.NewEncoder(w).Encode(s)
+	}
+	return fmt.Errorf("format must be text or json")
+}
+
+func summaryText(s SessionSummary) string {
+	seconds := func(n int64) string {
+		return (time.Duration(n) * time.Second).String()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "profile %d: %s - %s (%s)\n", s.Profile, s.Started.Format(TimeFormat), s.Ended.Format(TimeFormat), s.Ended.Sub(s.Started).Truncate(time.Second))
+	if s.Target != "" {
+		fmt.Fprintf(&b, "target: %s\n", s.Target)
+	}
+	fmt.Fprintf(&b, "time in target: %s\n", seconds(s.TimeInTargetSeconds))
+	fmt.Fprintf(&b, "time lost at home: %s\n", seconds(s.TimeLostSeconds))
+
+	causes := make([]string, 0, len(s.Causes))
+	for c, n := range s.Causes {
+		causes = append(causes, fmt.Sprintf("%s %d", c, n))
+	}
+	sort.Strings(causes)
+	fmt.Fprintf(&b, "disconnects: %d", s.Disconnects)
+	if len(causes) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(causes, ", "))
+	}
+	b.WriteString("\n")
+
+	rate := "n/a"
+	if r, ok := s.SuccessRate(); ok {
+		rate = fmt.Sprintf("%.0f%%", r*100)
+	}
+	fmt.Fprintf(&b, "rejoins: %d/%d succeeded (%s)\n", s.RejoinsSucceeded, s.Rejoins, rate)
+	return b.String()
+}
+
+// sessionSummary は Start してから at までの summary を返す
+func (v *VRCAutoRejoinTool) sessionSummary(at time.Time) (SessionSummary, bool) {
+	started, records := v.session.snapshot()
+	if started.IsZero() {
+		return SessionSummary{}, false
+	}
+	return summarizeSession(v.Profile, started, at, v.sessionTarget, records), true
+}
+
+// finishSession は Stop したときに summary を表示して保存し, summary_notify のときは通知する
+func (v *VRCAutoRejoinTool) finishSession() {
+	started, records := v.session.finish()
+	if started.IsZero() {
+		return
+	}
+	s := summarizeSession(v.Profile, started, v.clock.Now(), v.sessionTarget, records)
+	v.rejoinLock.Lock()
+	v.lastSummary = &s
+	v.rejoinLock.Unlock()
+	text := summaryText(s)
+	fmt.Print(text)
+	if err := saveSummary(v.Config.SummaryDir, s); err != nil {
+		log.Println("failed to save summary", err)
+	}
+	if v.Config.SummaryNotify {
+		v.notify("summary", text)
+	}
+}
+
+// saveSummary は summary を dir に JSON とテキストで保存する. dir が空のときは保存しない
+func saveSummary(dir string, s SessionSummary) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, s.Started.Format(incidentIDFormat)+fmt.Sprintf("-p%d", s.Profile))
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+".json", b, 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name+".txt", []byte(summaryText(s)), 0644)
+}
+
+// HasSession は Start してからまだ Stop で summary を作っていない監視があるかを返す
+// rejoin した後や諦めた後で監視が止まっていても, Stop するまでは true を返す
+func (v *VRCAutoRejoinTool) HasSession() bool {
+	started, _ := v.session.snapshot()
+	return !started.IsZero()
+}
+
+// Summaries は Stop するまでは今までの, Stop したときは最後の summary を返す
+func (v *VRCAutoRejoinTool) Summaries() []SessionSummary {
+	if s, ok := v.sessionSummary(v.clock.Now()); ok {
+		return []SessionSummary{s}
+	}
+	v.rejoinLock.Lock()
+	defer v.rejoinLock.Unlock()
+	if v.lastSummary != nil {
+		return []SessionSummary{*v.lastSummary}
+	}
+	return []SessionSummary{}
+}
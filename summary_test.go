@@ -0,0 +1,148 @@
+package vrcarjt
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummarizeSession(t *testing.T) {
+	const target = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"
+	const home = "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:99999~region(jp)"
+	started := time.Date(2021, 2, 14, 0, 0, 0, 0, time.Local)
+	at := func(h int, m int) time.Time {
+		return started.Add(time.Duration(h)*time.Hour + time.Duration(m)*time.Minute)
+	}
+
+	records := []HistoryRecord{
+		// Start する前から入っていた
+		{Time: started.Add(-time.Hour), Kind: HistoryEnter, Instance: target},
+		{Time: at(2, 0), Kind: HistoryDisconnect, Instance: target, Cause: CauseTimeout, Outcome: "rejoin"},
+		{Time: at(2, 0), Kind: HistoryExit, Instance: target},
+		{Time: at(2, 0), Kind: HistoryEnter, Instance: home},
+		{Time: at(2, 10), Kind: HistoryExit, Instance: home},
+		{Time: at(2, 10), Kind: HistoryEnter, Instance: target},
+		{Time: at(2, 10), Kind: HistoryRejoin, Instance: target, Outcome: "joined"},
+		{Time: at(5, 0), Kind: HistoryDisconnect, Instance: target, Cause: CauseCrash, Outcome: "rejoin"},
+		{Time: at(5, 0), Kind: HistoryExit, Instance: target},
+		{Time: at(5, 5), Kind: HistoryEnter, Instance: home},
+		{Time: at(5, 5), Kind: HistoryRejoin, Instance: target, Cause: CauseInstanceClosed, Outcome: "failed"},
+	}
+	s := summarizeSession(1, started, at(6, 0), target, records)
+
+	if s.TimeInTargetSeconds != int64((2*time.Hour+2*time.Hour+50*time.Minute)/time.Second) {
+		t.Errorf("unexpected time in target %s", time.Duration(s.TimeInTargetSeconds)*time.Second)
+	}
+	if s.TimeLostSeconds != int64((10*time.Minute+time.Hour)/time.Second) {
+		t.Errorf("unexpected time lost %s", time.Duration(s.TimeLostSeconds)*time.Second)
+	}
+	if s.Disconnects != 2 || s.Causes[CauseTimeout] != 1 || s.Causes[CauseCrash] != 1 {
+		t.Errorf("unexpected disconnects %d %v", s.Disconnects, s.Causes)
+	}
+	if rate, ok := s.SuccessRate(); !ok || rate != 0.5 {
+		t.Errorf("unexpected success rate %v %v", rate, ok)
+	}
+
+	var text bytes.Buffer
+	if err := WriteSummary(&text, s, "text"); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{"time in target: 4h50m0s", "time lost at home: 1h10m0s", "disconnects: 2 (crash 1, timeout 1)", "rejoins: 1/2 succeeded (50%)"} {
+		if !strings.Contains(text.String(), expect) {
+			t.Errorf("expect %q in\n%s", expect, text.String())
+		}
+	}
+	var got SessionSummary
+	var out bytes.Buffer
+	if err := WriteSummary(&out, s, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil || got.TimeLostSeconds != s.TimeLostSeconds {
+		t.Errorf("unexpected json %s %v", out.String(), err)
+	}
+
+	// 戻らないと決めた切断の後にホームにいた時間は失った時間に数えない
+	ignored := summarizeSession(1, started, at(2, 0), target, []HistoryRecord{
+		{Time: started, Kind: HistoryEnter, Instance: target},
+		{Time: at(1, 0), Kind: HistoryDisconnect, Instance: target, Cause: CauseKick, Outcome: "refused"},
+		{Time: at(1, 0), Kind: HistoryDisconnect, Instance: target, Cause: CauseMove, Outcome: "ignore"},
+		{Time: at(1, 0), Kind: HistoryExit, Instance: target},
+		{Time: at(1, 0), Kind: HistoryEnter, Instance: home},
+	})
+	if ignored.TimeLostSeconds != 0 || ignored.Disconnects != 2 {
+		t.Errorf("unexpected summary after an ignored disconnect %+v", ignored)
+	}
+
+	empty := summarizeSession(0, started, at(1, 0), "", nil)
+	if _, ok := empty.SuccessRate(); ok || !strings.Contains(summaryText(empty), "rejoins: 0/0 succeeded (n/a)") {
+		t.Errorf("unexpected empty summary\n%s", summaryText(empty))
+	}
+}
+
+func TestFinishSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summaries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const target = "wrld_cc124ed6-acec-4d55-9866-54ab66af172d:12345~region(jp)"
+	v := newVRCAutoRejoinTool(&Setting{SummaryDir: dir})
+	v.playSound = func(string) {}
+	clock := &fakeClock{now: time.Date(2021, 2, 14, 0, 0, 0, 0, time.Local)}
+	v.clock = clock
+	v.LatestInstance = Instance{ID: target}
+	v.sessionTarget = target
+	v.session.start(clock.now)
+	v.running = true
+	v.resumeVisit(Instance{ID: target, Time: clock.now})
+
+	clock.Sleep(3 * time.Hour)
+	v.decideRejoin(CauseTimeout, Instance{})
+	v.enterVisit(Instance{ID: "wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b:99999~region(jp)", Time: clock.now})
+	rec := httptest.NewRecorder()
+	NewAPIHandler(v).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/summary?format=text", nil))
+	if !strings.Contains(rec.Body.String(), "disconnects: 1 (timeout 1)") {
+		t.Errorf("expect the running summary got %s", rec.Body.String())
+	}
+
+	// rejoin した後で監視が止まっていても Stop で summary を作る
+	clock.Sleep(time.Hour)
+	v.running = false
+	v.exitVisit(clock.now)
+	if !v.HasSession() {
+		t.Error("session must remain until Stop")
+	}
+	if err := v.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if v.HasSession() {
+		t.Error("session must be summarized by Stop")
+	}
+
+	for _, ext := range []string{".json", ".txt"} {
+		if _, err := os.Stat(filepath.Join(dir, "20210214-000000-p0"+ext)); err != nil {
+			t.Errorf("summary must be saved: %v", err)
+		}
+	}
+	summaries := v.Summaries()
+	if len(summaries) != 1 || summaries[0].TimeInTargetSeconds != 3*60*60 || summaries[0].TimeLostSeconds != 60*60 {
+		t.Errorf("unexpected summary %+v", summaries)
+	}
+
+	// もう一度 Stop しても同じ監視の summary は作り直さない
+	clock.Sleep(time.Hour)
+	if err := v.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if summaries := v.Summaries(); len(summaries) != 1 || !summaries[0].Ended.Equal(time.Date(2021, 2, 14, 4, 0, 0, 0, time.Local)) {
+		t.Errorf("summary must not be rebuilt %+v", summaries)
+	}
+}
@@ -0,0 +1,48 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow は 1 日のうちの時間帯. start > end のときは日付をまたぐ
+type timeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseTimeWindow は "23:00-05:00" の形式の時間帯を読む
+func parseTimeWindow(s string) (*timeWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid time window %q. expected HH:MM-HH:MM", s)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &timeWindow{start: start, end: end}, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q. expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// contains は t の時刻が時間帯に含まれるかを返す
+// 夏時間が切り替わる日もずれないように, 0 時からの経過時間ではなく時計の時刻で比べる
+func (w *timeWindow) contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.start <= w.end {
+		return offset >= w.start && offset <= w.end
+	}
+	return offset >= w.start || offset <= w.end
+}
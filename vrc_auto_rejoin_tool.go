@@ -3,7 +3,6 @@ package vrcarjt
 import (
 	"errors"
 	"fmt"
-	"regexp"
 
 	"os/exec"
 	"runtime"
@@ -11,55 +10,145 @@ import (
 	"github.com/faiface/beep"
 	"github.com/faiface/beep/speaker"
 	"github.com/faiface/beep/wav"
-	"github.com/hpcloud/tail"
-	"github.com/jinzhu/now"
 	gops "github.com/mitchellh/go-ps"
 	"github.com/shirou/gopsutil/process"
 
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
-const WorldLogIdentifier = "] Destination set: wrld_"
-const Location = "Local"
 const TimeFormat = "2006.01.02 15:04:05"
-const vrcRelativeLogPath = `\AppData\LocalLow\VRChat\VRChat\`
 const Timeout = "Timeout: Your connection to VRChat timed out."
 
 var BuildVersion = "v0.0.0"
 
 func NewVRCAutoRejoinTool() *VRCAutoRejoinTool {
-	conf := LoadConf("setting.yml")
+	return newVRCAutoRejoinTool(LoadConf("setting.yml"))
+}
 
-	return &VRCAutoRejoinTool{
+func newVRCAutoRejoinTool(conf *Setting) *VRCAutoRejoinTool {
+	patterns, err := NewPatternRegistry(conf.LogPatterns)
+	if err != nil {
+		log.Println("invalid log_patterns fallback to default patterns")
+		log.Println(err)
+		patterns = defaultPatterns
+	}
+	loc, err := logLocation(conf.LogTimezone)
+	if err != nil {
+		log.Println("invalid log_timezone fallback to local timezone")
+		log.Println(err)
+		loc = time.Local
+	}
+
+	v := &VRCAutoRejoinTool{
 		Config:         conf,
 		Args:           "",
 		LatestInstance: Instance{},
 		EnableRejoin:   !conf.EnableSleepDetector, // EnableSleepDetectorがOnのとき即座にインスタンス移動の検出をしないため
 		InSleep:        false,
 		rejoinLock:     &sync.Mutex{},
+		targetLock:     &sync.Mutex{},
 		playAudioLock:  &sync.Mutex{},
 		running:        false,
 		shutdown:       false,
+		clock:          realClock{},
+		crashLoop:      newCrashLoopBreaker(realClock{}, conf.CrashLoop),
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		patterns:       patterns,
+		moves:          newMoveClassifier(patterns, loc, conf.HomeWorld),
+		roster:         newRoster(patterns),
+		events:         newEventLog(),
+		history:        newHistoryJournal(conf),
+		incidents:      newIncidentRecorder(conf),
+		session:        newSessionLog(),
+		location:       loc,
+		skew:           time.Duration(conf.LogTimeSkewSeconds) * time.Second,
+	}
+	v.playSound = v.playAudioFile
+	v.otherLogs = func() map[string]bool { return map[string]bool{} }
+	if conf.CrashLoop.MaxRejoins > 0 && !conf.EnableDaemon {
+		log.Println("crash_loop needs enable_daemon. without it the tool stops after the first rejoin")
 	}
+	// rules が間違っているときは Run でエラーを返して監視を始めない
+	v.rules, v.rulesErr = compileRules(conf)
+	return v
 }
 
 // VRCAutoRejoinTool ...
 type VRCAutoRejoinTool struct {
-	Config         *Setting
+	Config *Setting
+	// PID と LogPath が指定されているときは VRChat.exe を名前で探さずにそのプロセスとログを監視する
+	// Run した後は PID, LogPath, LatestInstance を API などの他の goroutine からも読み書きするので targetLock を取って使う
+	PID            int32
+	Profile        int
+	LogPath        string
 	Args           string
+	Process        ProcessContext
 	LatestInstance Instance
 	EnableRejoin   bool
 	InSleep        bool
 	rejoinLock     *sync.Mutex
+	targetLock     *sync.Mutex
 	playAudioLock  *sync.Mutex
 	running        bool
 	shutdown       bool
+	clock          clock
+	hang           *hangWatchdog
+	crashLoop      *crashLoopBreaker
+	// generation は Run のたびに増やし, 前回の Run で起動した watcher を止めるために使う
+	// follower は generation 回目の Run で始めたログの追跡
+	generation int
+	follower   *logFollower
+	// keepTarget が true のときは Run で LatestInstance をログから読み直さない
+	keepTarget bool
+	launch     LaunchProfile
+	// verifying は rearm した後に入ったインスタンスがまだ確認できていないことを表す
+	verifying      bool
+	fallbackStep   int
+	fallbackTarget Instance
+	rand           *rand.Rand
+	patterns       *PatternRegistry
+	moves          *moveClassifier
+	roster         *roster
+	events         *eventLog
+	// candidate は自分で移動して follow_latest_minutes が経つのを待っているインスタンス
+	candidate      Instance
+	candidateSince time.Time
+	// rules は rejoin するかを決めるルール. rulesErr は rules を読めなかったときのエラー
+	// rejoins は続けて rejoin した回数で, rejoin できたことを確かめたら 0 に戻す
+	rules      []compiledRule
+	rulesErr   error
+	rejoins    int
+	ruleTarget Instance
+	// playSound は音を鳴らす. テストでは差し替える
+	playSound func(path string)
+	// pinned が指定されているときはログから読んだインスタンスの代わりに pinned に戻る
+	pinned Instance
+	// blocked はキックや BAN で戻らないことにしたインスタンス
+	blocked []blockedTarget
+	// otherLogs は同時に監視している他のクライアントのログを返す. ClientManager が設定する
+	otherLogs func() map[string]bool
+	// lastJoinFailure は直前に rejoin したインスタンスに入れなかった理由
+	lastJoinFailure RejoinCause
+	// history は訪れたインスタンスと rejoin の履歴, visit は今いると記録したインスタンス
+	history *historyJournal
+	visit   Instance
+	// incidents は切断や rejoin のたびに前後のログ付きで記録する
+	incidents *incidentRecorder
+	// session は Start してからの履歴, sessionTarget は Start したときの戻るインスタンス, lastSummary は最後に Stop したときの summary
+	session       *sessionLog
+	sessionTarget string
+	lastSummary   *SessionSummary
+	// location はログの時刻のタイムゾーン, skew はログの時刻と PC の時計のずれとして許容する幅
+	location *time.Location
+	skew     time.Duration
 }
 
 type AutoRejoin interface {
@@ -69,6 +158,53 @@ type AutoRejoin interface {
 	SleepStart()
 	Stop() error
 	GetUserHome() string
+	Status() []ClientStatus
+	Pin(profile int, target string) error
+	Unpin(profile int) error
+	Bookmarks() []Bookmark
+	Events() []Event
+	History(q HistoryQuery) ([]HistoryRecord, error)
+	Incidents() ([]Incident, error)
+	Incident(id string) (Incident, error)
+	Summaries() []SessionSummary
+	HasSession() bool
+}
+
+// ClientStatus is the monitoring state of a VRChat client
+type ClientStatus struct {
+	PID       int32            `json:"pid"`
+	Profile   int              `json:"profile"`
+	LogPath   string           `json:"log_path"`
+	Running   bool             `json:"running"`
+	Target    string           `json:"target"`
+	Pinned    bool             `json:"pinned"`
+	LocalUser string           `json:"local_user,omitempty"`
+	Instance  string           `json:"instance,omitempty"`
+	Players   []string         `json:"players"`
+	CrashLoop *CrashLoopStatus `json:"crash_loop,omitempty"`
+}
+
+func (v *VRCAutoRejoinTool) Status() []ClientStatus {
+	crashLoop := v.crashLoop.status()
+	instance, players := v.roster.current()
+	user := v.roster.user()
+	pid, logPath := v.client()
+	target := v.target()
+	pinned := v.isPinned()
+	v.rejoinLock.Lock()
+	defer v.rejoinLock.Unlock()
+	return []ClientStatus{{
+		PID:       pid,
+		Profile:   v.Profile,
+		LogPath:   logPath,
+		Running:   v.running,
+		Target:    target.ID,
+		Pinned:    pinned,
+		LocalUser: user,
+		Instance:  instance,
+		Players:   players,
+		CrashLoop: crashLoop,
+	}}
 }
 
 func (v *VRCAutoRejoinTool) IsRun() bool {
@@ -82,6 +218,13 @@ func (v *VRCAutoRejoinTool) IsShutdown() bool {
 	return v.shutdown
 }
 
+// isWatching は generation 回目の Run で起動した watcher が監視を続けてよいかを返す
+func (v *VRCAutoRejoinTool) isWatching(generation int) bool {
+	v.rejoinLock.Lock()
+	defer v.rejoinLock.Unlock()
+	return v.running && !v.shutdown && v.generation == generation
+}
+
 func (v *VRCAutoRejoinTool) SleepStart() {
 	v.rejoinLock.Lock()
 	defer v.rejoinLock.Unlock()
@@ -89,14 +232,20 @@ func (v *VRCAutoRejoinTool) SleepStart() {
 }
 
 func (v *VRCAutoRejoinTool) Stop() error {
-	if !v.running {
-		return nil
-	}
 	v.rejoinLock.Lock()
-	defer v.rejoinLock.Unlock()
-	go v.playAudioFile("stop.wav")
-	v.running = false
+	v.stopFollower()
+	if v.running {
+		go v.playAudioFile("stop.wav")
+		v.running = false
+		v.saveState(false)
+		v.exitVisit(v.clock.Now())
+		v.incidents.resolve(v.clock.Now(), "stopped")
+	}
+	v.rejoinLock.Unlock()
 
+	// rejoin した後や諦めた後で監視が止まっていても, 始めた監視があれば summary を作る
+	// summary の通知は時間がかかることがあるのでロックの外で行う
+	v.finishSession()
 	return nil
 }
 
@@ -115,15 +264,10 @@ func (v *VRCAutoRejoinTool) GetUserHome() string {
 	return os.Getenv("HOME")
 }
 
-func init() {
-	var err error
-	time.Local, err = time.LoadLocation(Location)
-	if err != nil {
-		time.Local = time.FixedZone(Location, 9*60*60)
-	}
-}
-
 func (v *VRCAutoRejoinTool) Run() error {
+	if v.rulesErr != nil {
+		return fmt.Errorf("invalid rules. %s", v.rulesErr)
+	}
 
 	home := v.GetUserHome()
 
@@ -132,7 +276,12 @@ func (v *VRCAutoRejoinTool) Run() error {
 	}
 
 	var err error
-	v.Args, err = v.findProcessArgsByName("VRChat.exe")
+	pid, latestLog := v.client()
+	if pid != 0 {
+		v.Args, v.Process, err = v.findProcessArgsByPID(pid)
+	} else {
+		v.Args, v.Process, err = v.findProcessArgsByName("VRChat.exe")
+	}
 	if err == ErrProcessNotFound {
 		go v.playAudioFile("start_vrc.wav")
 		v.rejoinLock.Lock()
@@ -150,43 +299,175 @@ func (v *VRCAutoRejoinTool) Run() error {
 	v.rejoinLock.Lock()
 	v.running = true
 	v.shutdown = false
+	v.generation++
+	generation := v.generation
+	v.stopFollower()
 	v.rejoinLock.Unlock()
 
 	go v.playAudioFile("start.wav")
-	path := home + vrcRelativeLogPath
-	latestLog, err := v.fetchLatestLogName(path)
-	if err != nil {
-		return fmt.Errorf("log file not found. %s", err)
+	if latestLog == "" {
+		path, err := findLogDir(runtime.GOOS, home, v.Config.LogDir)
+		if err != nil {
+			return v.abortRun(err)
+		}
+		name, err := v.fetchLatestLogName(path)
+		if err != nil {
+			return v.abortRun(fmt.Errorf("log file not found. %s", err))
+		}
+		if name == "" {
+			return v.abortRun(fmt.Errorf("log file not found in %s", path))
+		}
+		latestLog = filepath.Join(path, name)
 	}
+	v.setClient(pid, latestLog)
 
 	start := time.Now().In(time.Local)
 	fmt.Println("RUNNING START AT", start.Format(TimeFormat))
 
-	v.LatestInstance, err = v.ParseLatestInstance(path + latestLog)
+	// rearm で立ち上げ直したときは元のインスタンスと crash loop の状態を引き継ぐ
+	// ParseLatestInstance で読んだ後に追記された分から監視する. 書き込み途中の行はその行の先頭から読む
+	offset, err := logFollowOffset(latestLog)
 	if err != nil {
-		return err
+		log.Println(err)
+	}
+	// ツールを立ち上げ直したときは保存した状態から戻るインスタンスを引き継ぎ, 今いるインスタンスが違えば戻る
+	// 固定したインスタンスがあるときはログから読んだインスタンスの代わりに使う
+	rejoinNow := false
+	if !v.keepTarget {
+		current, err := v.ParseLatestInstance(latestLog)
+		if err != nil {
+			return v.abortRun(err)
+		}
+		// 前の監視が rejoin した後や諦めた後で止まったまま Stop されていないときは, その summary を先に作る
+		v.finishSession()
+		v.session.start(v.clock.Now())
+		v.resumeVisit(current)
+		if v.restoreState() {
+			log.Println("restored target instance", v.target().ID)
+			if v.verifying {
+				rejoinNow = !v.verifyRejoin(current)
+			} else {
+				rejoinNow = !SameInstance(current.ID, v.target().ID)
+			}
+		} else {
+			v.rejoins = 0
+			v.crashLoop.reset()
+			v.launch = LaunchProfile{}
+			v.verifying = false
+			v.targetLock.Lock()
+			v.LatestInstance = current
+			v.ruleTarget = Instance{}
+			v.fallbackStep = 0
+			v.fallbackTarget = Instance{}
+			v.targetLock.Unlock()
+		}
+		v.targetLock.Lock()
+		if v.pinned.ID != "" && !SameInstance(v.LatestInstance.ID, v.pinned.ID) {
+			log.Println("pinned target instance", v.pinned.ID)
+			v.LatestInstance = v.pinned
+			v.verifying = false
+			v.fallbackStep = 0
+			v.fallbackTarget = Instance{}
+		}
+		v.sessionTarget = v.LatestInstance.ID
+		v.targetLock.Unlock()
+	}
+	v.keepTarget = false
+	v.saveState(true)
+	if err := v.history.prune(v.clock.Now()); err != nil {
+		log.Println("failed to prune history", err)
+	}
+	if err := v.roster.rebuild(latestLog); err != nil {
+		log.Println("failed to read players from log", err)
 	}
 
-	t, err := tail.TailFile(path+latestLog, tail.Config{
-		Follow:    true,
-		MustExist: true,
-		ReOpen:    true,
-		Poll:      true,
-	})
+	t := followLog(latestLog, offset)
+	v.setFollower(generation, t)
+	if v.Config.EnableProcessCheck {
+		go v.processWatcher(generation)
+	}
+	v.hang = newHangWatchdog(v.clock, v.Config)
+	if v.hang.enabled() {
+		go v.hangWatcher(generation)
+	}
+	memory, err := newMemoryWatchdog(v.clock, v.Config)
 	if err != nil {
-		v.rejoinLock.Lock()
-		v.running = false
-		v.rejoinLock.Unlock()
-		return err
+		log.Println(err)
+	} else if memory.enabled() {
+		go v.memoryWatcher(generation, memory)
 	}
-	if v.Config.EnableProcessCheck {
-		go v.processWatcher()
+	if v.Config.FollowLatestMinutes > 0 {
+		go v.followWatcher(generation)
 	}
-	go v.logInspector(t, start)
+	// 保存した状態から戻るときは, ログの監視で同時に rejoin しないように戻ってからログを監視する
+	go func() {
+		if rejoinNow {
+			log.Println("current instance is not the target instance")
+			if v.decideRejoin(CauseRestore, Instance{}) && v.noticeAndRejoin(true) {
+				t.Stop()
+				return
+			}
+		}
+		v.logInspector(t, start, generation)
+	}()
 
 	return nil
 }
 
+// setFollower は generation 回目の Run で始めたログの追跡を覚える. 既に次の Run が始まっていたときは止める
+func (v *VRCAutoRejoinTool) setFollower(generation int, f *logFollower) {
+	v.rejoinLock.Lock()
+	defer v.rejoinLock.Unlock()
+	if v.generation != generation {
+		f.Stop()
+		return
+	}
+	v.follower = f
+}
+
+// stopFollower は前の Run で始めたログの追跡を止める. rejoinLock を取って呼ぶ
+// 落ちた VRChat のログには次の行が来ないため, generation を確かめる行を待たずに止める
+func (v *VRCAutoRejoinTool) stopFollower() {
+	if v.follower != nil {
+		v.follower.Stop()
+		v.follower = nil
+	}
+}
+
+// target は戻るインスタンスを返す
+func (v *VRCAutoRejoinTool) target() Instance {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	return v.LatestInstance
+}
+
+func (v *VRCAutoRejoinTool) isPinned() bool {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	return v.pinned.ID != ""
+}
+
+// client は監視している VRChat の pid とログのパスを返す. pid が 0 のときは名前で探す
+func (v *VRCAutoRejoinTool) client() (int32, string) {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	return v.PID, v.LogPath
+}
+
+func (v *VRCAutoRejoinTool) setClient(pid int32, logPath string) {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	v.PID, v.LogPath = pid, logPath
+}
+
+// abortRun は監視を始められなかったときに実行中の状態を戻して err を返す
+func (v *VRCAutoRejoinTool) abortRun(err error) error {
+	v.rejoinLock.Lock()
+	v.running = false
+	v.rejoinLock.Unlock()
+	return err
+}
+
 func (v *VRCAutoRejoinTool) rejoin(i Instance, killProcess bool) error {
 	v.rejoinLock.Lock()
 	v.shutdown = true
@@ -195,26 +476,61 @@ func (v *VRCAutoRejoinTool) rejoin(i Instance, killProcess bool) error {
 		v.rejoinLock.Unlock()
 	}()
 	if killProcess {
-		err := v.killProcessByName("VRChat.exe")
+		err := v.killProcess()
 		if err != nil {
 			log.Println(err)
 		}
 	}
 
-	args := prepareExecArgs(v.Args, i)
+	if v.launch.World != "" {
+		i = Instance{ID: v.launch.World}
+	}
+	args := v.launch.apply(prepareExecArgs(v.Args, i))
+	if runtime.GOOS == "linux" {
+		// steam が起動する VRChat には steam の実行環境が使われるため, 元の VRChat の実行環境は引き継がない
+		args = steamLaunch(v.Config.SteamPath, args)
+		return exec.Command(args.ExePath, args.Args...).Start()
+	}
 	cmd := exec.Command(args.ExePath, args.Args...)
+	cmd.Dir = v.Process.Dir
+	if env := filterEnv(v.Process.Env, v.Config.EnvAllow, v.Config.EnvDeny); len(env) > 0 {
+		cmd.Env = mergeEnv(os.Environ(), env)
+	}
 
 	return cmd.Start()
 }
 
+// ParseLatestInstance はログを末尾から読み, 最後に移動したインスタンスを返す
+// 一晩で数百MBになるログを全て読み込まないように, 見つかったところで読むのをやめる
 func (v *VRCAutoRejoinTool) ParseLatestInstance(path string) (Instance, error) {
-	content, err := ioutil.ReadFile(path)
+	f, err := os.Open(path)
 	if err != nil {
 		log.Println(err)
 		return Instance{}, err
 	}
+	defer f.Close()
 
-	return v.parseLatestInstance(string(content))
+	stat, err := f.Stat()
+	if err != nil {
+		return Instance{}, err
+	}
+
+	return parseLatestInstanceReverse(f, stat.Size(), reverseChunkSize, v.patterns, v.location)
+}
+
+// logFollowOffset は path の最後の改行の後ろの位置を返す
+func logFollowOffset(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return completeLinesSize(f, stat.Size(), reverseChunkSize)
 }
 
 // ErrProcessNotFound is an error that is returned when the target process could not be found
@@ -235,23 +551,67 @@ func (v *VRCAutoRejoinTool) findProcessPIDByName(name string) (int32, error) {
 	return -1, ErrProcessNotFound
 }
 
-func (v *VRCAutoRejoinTool) findProcessArgsByName(name string) (string, error) {
+func (v *VRCAutoRejoinTool) findProcessArgsByName(name string) (string, ProcessContext, error) {
 	pid, err := v.findProcessPIDByName(name)
 	if err != nil {
-		return "", ErrProcessNotFound
+		return "", ProcessContext{}, ErrProcessNotFound
 	}
 
+	return v.findProcessArgsByPID(pid)
+}
+
+func (v *VRCAutoRejoinTool) findProcessArgsByPID(pid int32) (string, ProcessContext, error) {
 	p, err := process.NewProcess(pid)
 	if err != nil {
 		log.Println(err)
+		return "", ProcessContext{}, err
+	}
+
+	args, err := processCommandLine(runtime.GOOS, p)
+	if err != nil {
+		return "", ProcessContext{}, err
+	}
+
+	return args, readProcessContext(p), nil
+}
+
+// cmdlineReader は gopsutil の process.Process のうちコマンドラインを読むメソッド
+type cmdlineReader interface {
+	Cmdline() (string, error)
+	CmdlineSlice() ([]string, error)
+}
+
+// processCommandLine は splitCommandLine で argv に戻せるコマンドラインを返す
+// Windows 以外の Cmdline は argv を空白でつなぐだけで空白を含む引数が分かれてしまうため, argv をクォートしてつなぎ直す
+func processCommandLine(goos string, p cmdlineReader) (string, error) {
+	if goos == "windows" {
+		return p.Cmdline()
+	}
+	argv, err := p.CmdlineSlice()
+	if err != nil {
 		return "", err
 	}
+	return joinCommandLine(argv), nil
+}
 
-	return p.Cmdline()
+// findProcessPID は監視している VRChat.exe の pid を返す
+func (v *VRCAutoRejoinTool) findProcessPID() (int32, error) {
+	pid, _ := v.client()
+	if pid == 0 {
+		return v.findProcessPIDByName("VRChat.exe")
+	}
+	ok, err := process.PidExists(pid)
+	if err != nil {
+		return -1, err
+	}
+	if !ok {
+		return -1, ErrProcessNotFound
+	}
+	return pid, nil
 }
 
-func (v *VRCAutoRejoinTool) killProcessByName(name string) error {
-	pid, err := v.findProcessPIDByName(name)
+func (v *VRCAutoRejoinTool) killProcess() error {
+	pid, err := v.findProcessPID()
 	if err != nil {
 		return err
 	}
@@ -314,14 +674,14 @@ func (v *VRCAutoRejoinTool) parseLatestInstance(s string) (Instance, error) {
 			line = line[:len(line)-1]
 		}
 
-		if !strings.Contains(line, WorldLogIdentifier) {
+		// 書き込み途中や壊れた行は読み飛ばして, 最後に読めたインスタンスを使う
+		instance, err := v.patterns.Instance(line, v.location)
+		if err == ErrWorldLogNotFound {
 			continue
-
 		}
-
-		instance, err := NewInstanceByLog(line)
 		if err != nil {
-			return instance, err
+			log.Println(err)
+			continue
 		}
 		latestInstance = instance
 	}
@@ -352,25 +712,20 @@ func (v *VRCAutoRejoinTool) fetchLatestLogName(path string) (string, error) {
 	return latestLog, nil
 }
 
-func (v *VRCAutoRejoinTool) processWatcher() {
+func (v *VRCAutoRejoinTool) processWatcher(generation int) {
 
-	for v.IsRun() && !v.IsShutdown() {
+	for v.isWatching(generation) {
 		log.Println("process watcher available")
-		_, err := v.findProcessPIDByName("VRChat.exe")
+		_, err := v.findProcessPID()
 		if err == ErrProcessNotFound {
-			if v.Config.EnableRejoinNotice {
-				go v.playAudioFile("rejoin_notice.wav")
-				time.Sleep(1 * time.Minute)
-			}
-			// 警告オーディオ再生中に止まった場合なにもしない
-			if !v.running {
-				log.Println("cancel rejoin")
-				v.shutdown = true
+			v.crashLoop.failed()
+			if !v.decideRejoin(CauseCrash, Instance{}) {
 				return
 			}
-			err := v.rejoin(v.LatestInstance, false)
-			if err != nil {
-				log.Println(err)
+			if !v.noticeAndRejoin(false) {
+				v.rejoinLock.Lock()
+				v.shutdown = true
+				v.rejoinLock.Unlock()
 			}
 			return
 		}
@@ -380,59 +735,367 @@ func (v *VRCAutoRejoinTool) processWatcher() {
 
 }
 
-func (v *VRCAutoRejoinTool) logInspector(tail *tail.Tail, at time.Time) {
+// hangWatcher はプロセスが残ったまま固まった VRChat を終了させて入り直す
+func (v *VRCAutoRejoinTool) hangWatcher(generation int) {
+	pid, err := v.findProcessPID()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	p, err := newProcessSampler(pid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	for msg := range tail.Lines {
-		if !v.IsRun() || v.IsShutdown() {
-			log.Println("log watcher clean up by other.")
-			tail.Cleanup()
-			break
-		}
+	reason, hung := v.hang.wait(p, func() bool {
+		return v.isWatching(generation)
+	})
+	if !hung {
+		log.Println("hang watcher clean up by other.")
+		return
+	}
+
+	log.Println("hang detected:", reason)
+	v.crashLoop.failed()
+	if v.decideRejoin(CauseHang, Instance{}) {
+		v.noticeAndRejoin(true)
+	}
+}
+
+// memoryWatcher は長時間の起動でメモリが増えた VRChat を計画的に同じインスタンスへ再起動する
+func (v *VRCAutoRejoinTool) memoryWatcher(generation int, m *memoryWatchdog) {
+	pid, err := v.findProcessPID()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	p, err := newProcessSampler(pid)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	reason, restart := m.wait(p, func() bool {
+		return v.isWatching(generation)
+	})
+	if !restart {
+		log.Println("memory watcher clean up by other.")
+		return
+	}
+
+	v.notify("planned restart", reason)
+	if v.decideRejoin(CauseMemory, Instance{}) {
+		v.noticeAndRejoin(true)
+	}
+}
+
+// noticeAndRejoin は rejoin の通知を鳴らしてから LatestInstance に入り直す
+// 通知中に止められたときや crash loop で諦めたときは入り直さずに false を返す
+func (v *VRCAutoRejoinTool) noticeAndRejoin(killProcess bool) bool {
+	v.cancelCandidate()
+	target, ok := v.rejoinTarget()
+	if !ok {
+		v.notify("rejoin failed", "instance "+v.target().ID+" is gone and no fallback is left. stay in the current instance")
+		v.incidents.resolve(v.clock.Now(), "gave up: no fallback is left")
+		v.saveState(false)
+		v.rejoinLock.Lock()
+		v.running = false
+		v.shutdown = true
+		v.rejoinLock.Unlock()
+		return false
+	}
 
-		logLine := msg.Text
+	profile, backoff, ok := v.crashLoop.attempt()
+	if !ok {
+		v.notify("crash loop", "VRChat keeps crashing after rejoin. gave up rejoining to "+v.target().ID)
+		v.incidents.resolve(v.clock.Now(), "gave up: crash loop")
+		v.saveState(false)
+		v.rejoinLock.Lock()
+		v.running = false
+		v.shutdown = true
+		v.rejoinLock.Unlock()
+		return false
+	}
+	if profile.Name != v.launch.Name {
+		v.notify("crash loop", "rejoin with fallback launch profile "+profile.Name)
+	}
+	v.launch = profile
+	v.saveState(true)
+	if backoff > 0 {
+		log.Println("crash loop backoff", backoff)
+		v.clock.Sleep(backoff)
+	}
 
-		if !v.isMove(at, logLine) && !v.isTimeout(logLine) {
+	if v.Config.EnableRejoinNotice {
+		go v.playAudioFile("rejoin_notice.wav")
+		time.Sleep(1 * time.Minute)
+	}
+	// 警告オーディオ再生中に止まった場合なにもしない
+	if !v.IsRun() {
+		log.Println("cancel rejoin")
+		v.incidents.resolve(v.clock.Now(), "cancelled")
+		return false
+	}
+	launched := v.clock.Now()
+	v.rejoins++
+	err := v.rejoin(target, killProcess)
+	if err != nil {
+		log.Println(err)
+		v.incidents.resolve(v.clock.Now(), "failed to launch: "+err.Error())
+		return true
+	}
+	// enable_daemon でないときは入れたかを確かめられないので起動したところまでを記録する
+	if !v.Config.EnableDaemon {
+		v.incidents.resolve(launched, "launched "+target.ID)
+		return true
+	}
+	v.incidents.step(launched, fmt.Sprintf("rejoin %d launched %s", v.rejoins, target.ID))
+	go v.rearm(launched)
+	return true
+}
+
+const (
+	rearmInterval = 10 * time.Second
+	rearmTimeout  = 5 * time.Minute
+)
+
+// rearm は enable_daemon のとき, 立ち上げ直した VRChat のプロセスとログが現れるのを待って同じインスタンスの監視を続ける
+func (v *VRCAutoRejoinTool) rearm(launched time.Time) {
+	v.rejoinLock.Lock()
+	v.running = true
+	v.rejoinLock.Unlock()
+
+	oldPID, oldLog := v.client()
+	for v.clock.Now().Sub(launched) < rearmTimeout {
+		v.clock.Sleep(rearmInterval)
+		if !v.IsRun() {
+			log.Println("cancel rearm")
+			return
+		}
+
+		pid, err := findRelaunchedPID(v.Profile, oldPID)
+		if err != nil {
+			continue
+		}
+		used := v.otherLogs()
+		logs, err := findClientLogs(filepath.Dir(oldLog), len(used)+1, v.location)
+		if err != nil {
+			continue
+		}
+		path, ok := relaunchedLog(logs, launched, used)
+		if !ok {
 			continue
 		}
 
-		log.Println("instance move detected")
+		// 名前で探しているときは pid を指定しない
+		if oldPID == 0 {
+			pid = 0
+		}
+		v.setClient(pid, path)
+		v.keepTarget = true
+		v.verifying = true
+		if err := v.Run(); err != nil {
+			log.Println(err)
+		}
+		return
+	}
 
-		if v.Config.EnableRadioExercises {
-			start, err := now.ParseInLocation(time.Local, "05:45")
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	v.notify("rejoin failed", "VRChat did not start within "+rearmTimeout.String())
+	v.incidents.resolve(v.clock.Now(), "VRChat did not start")
+	v.rejoinLock.Lock()
+	v.running = false
+	v.rejoinLock.Unlock()
+}
+
+// rejoinTarget は rejoin で入るインスタンスを返す. fallback を使い切ったときは false を返す
+func (v *VRCAutoRejoinTool) rejoinTarget() (Instance, bool) {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	if v.ruleTarget.ID != "" {
+		return v.ruleTarget, true
+	}
+	if v.fallbackStep == 0 {
+		return v.LatestInstance, true
+	}
+	return v.fallbackTarget, v.fallbackTarget.ID != ""
+}
+
+// nextFallback は元のインスタンスに戻れなかったときに次に入るインスタンスを選ぶ
+func (v *VRCAutoRejoinTool) nextFallback() {
+	v.targetLock.Lock()
+	defer v.targetLock.Unlock()
+	v.advanceFallback()
+}
+
+// advanceFallback は targetLock を取った状態で次の fallback に進める. 使えない fallback は飛ばす
+func (v *VRCAutoRejoinTool) advanceFallback() {
+	v.fallbackStep++
+	v.fallbackTarget = Instance{}
 
-			end, err := now.ParseInLocation(time.Local, "08:00")
+	n := v.fallbackStep - 1
+	if v.Config.FallbackNewInstance {
+		if n == 0 {
+			id, err := ParseInstanceID(v.LatestInstance.ID)
 			if err != nil {
 				log.Println(err)
-				continue
+				v.advanceFallback()
+				return
+			}
+			n, ok := id.NewInstance(v.rand, v.roster.userID())
+			if !ok {
+				log.Println("cannot create a new instance of", id.AccessType, "owned by other user. skip to the next fallback")
+				v.advanceFallback()
+				return
 			}
+			v.fallbackTarget = Instance{ID: n.String()}
+			return
+		}
+		n--
+	}
+	if n < len(v.Config.FallbackWorlds) {
+		v.fallbackTarget = Instance{ID: v.Config.FallbackWorlds[n]}
+	}
+}
+
+// verifyRejoin は rearm した後に入ったインスタンスが rejoin で入ろうとしたインスタンスかを確かめる
+// 違ったときは入れなかった理由によって同じインスタンスに入り直すか次の fallback を選んで false を返す
+func (v *VRCAutoRejoinTool) verifyRejoin(i Instance) bool {
+	target, _ := v.rejoinTarget()
+	v.verifying = false
+	v.targetLock.Lock()
+	v.ruleTarget = Instance{}
+	original, fellBack := v.LatestInstance, v.fallbackStep > 0
+	v.targetLock.Unlock()
+
+	if SameInstance(i.ID, target.ID) {
+		if fellBack {
+			v.notify("fallback", "original instance "+original.ID+" is gone. joined "+i.ID)
+		}
+		v.targetLock.Lock()
+		v.LatestInstance = i
+		v.fallbackStep = 0
+		v.fallbackTarget = Instance{}
+		v.targetLock.Unlock()
+		v.lastJoinFailure = ""
+		v.rejoins = 0
+		v.crashLoop.recovered()
+		v.saveState(true)
+		v.recordHistory(HistoryRecord{Kind: HistoryRejoin, Instance: target.ID, Outcome: "joined"})
+		v.incidents.resolve(v.clock.Now(), "joined "+i.ID)
+		return true
+	}
+
+	cause := v.joinFailureCause(i)
+	log.Println("rejoin verification failed. expect", target.ID, "got", i.ID, "("+string(cause)+")")
+	v.crashLoop.failed()
+	v.recordHistory(HistoryRecord{Kind: HistoryRejoin, Instance: target.ID, Cause: cause, Outcome: "failed"})
+	v.incidents.step(v.clock.Now(), fmt.Sprintf("could not join %s (%s). landed in %s", target.ID, cause, i.ID))
+	if v.retryJoin(cause) {
+		v.saveState(true)
+		return false
+	}
+	v.nextFallback()
+	v.saveState(true)
+	return false
+}
+
+// observe はログの 1 行で移動の理由, 名簿, 履歴を更新する
+func (v *VRCAutoRejoinTool) observe(logLine string) {
+	v.moves.observe(logLine)
+	v.observeRoster(logLine)
+	v.observeHistory(logLine)
+}
+
+// checkRejoined は rearm した後の移動先のログで rejoin できたかを確かめ, もう一度 rejoin するかを返す
+func (v *VRCAutoRejoinTool) checkRejoined(logLine string, i Instance) bool {
+	// 入れなかった理由は移動先のログを記録すると消えるので先に調べる
+	cause := v.joinFailureCause(i)
+	verified := v.verifyRejoin(i)
+	v.observe(logLine)
+	return !verified && v.decideRejoin(cause, i)
+}
+
+// findRelaunchedPID は立ち上げ直した同じ profile の VRChat.exe の pid を返す
+func findRelaunchedPID(profile int, oldPID int32) (int32, error) {
+	procs, err := findClientProcesses("VRChat.exe")
+	if err != nil {
+		return -1, err
+	}
+	for _, p := range procs {
+		if p.Profile == profile && p.PID != oldPID {
+			return p.PID, nil
+		}
+	}
+	return -1, ErrProcessNotFound
+}
 
-			if v.inTimeRange(start, end, time.Now().In(time.Local)) {
-				continue
+// detectRejoin はログの 1 行から戻るべき移動や切断を検出して移動先と理由を返す
+// ポータルやメニューから自分で移動したときは戻らずに移動先を戻るインスタンスにする
+func (v *VRCAutoRejoinTool) detectRejoin(at time.Time, logLine string) (Instance, RejoinCause, bool) {
+	var (
+		destination Instance
+		cause       RejoinCause
+		moved       bool
+	)
+	if v.isMove(at, logLine) {
+		destination, cause, moved = v.forcedMove(logLine)
+	}
+	v.observeJoinFailure(logLine)
+	v.observe(logLine)
+	if !moved && v.isTimeout(logLine) {
+		cause, moved = CauseTimeout, true
+		// キックされた後の切断はキックとして扱う
+		if lt, err := parseLogTime(logLine, v.location); err == nil {
+			if c, ok := v.moves.moderatedBefore(lt); ok {
+				cause = c
 			}
 		}
+	}
+	return destination, cause, moved
+}
+
+func (v *VRCAutoRejoinTool) logInspector(tail *logFollower, at time.Time, generation int) {
 
-		if v.Config.EnableRejoinNotice {
-			go v.playAudioFile("rejoin_notice.wav")
-			time.Sleep(1 * time.Minute)
+	for entry := range tail.Entries() {
+		if !v.isWatching(generation) {
+			log.Println("log watcher clean up by other.")
+			tail.Stop()
+			break
 		}
 
-		// 警告オーディオ再生中に止まった場合なにもしない
-		if !v.running {
-			tail.Cleanup()
-			log.Println("cancel rejoin")
-			return
+		logLine := entry.Header()
+		v.incidents.entry(entry.Lines)
+		if v.hang != nil {
+			v.hang.logReceived()
 		}
 
-		err := v.rejoin(v.LatestInstance, true)
-		if err != nil {
-			log.Println(err)
+		if v.verifying {
+			i, err := v.patterns.Instance(logLine, v.location)
+			if err == nil && logTimeNotBefore(i.Time, at, v.skew) {
+				if !v.checkRejoined(logLine, i) {
+					continue
+				}
+				v.noticeAndRejoin(true)
+				tail.Stop()
+				return
+			}
 		}
 
-		tail.Cleanup()
+		destination, cause, moved := v.detectRejoin(at, logLine)
+		if !moved {
+			continue
+		}
+
+		log.Println("instance move detected")
+
+		// 体操の時間などは rules で rejoin しないことがある
+		if !v.decideRejoin(cause, destination) {
+			continue
+		}
+
+		v.noticeAndRejoin(true)
+		tail.Stop()
 		return
 	}
 }
@@ -442,19 +1105,16 @@ func (v *VRCAutoRejoinTool) isMove(at time.Time, l string) bool {
 		return false
 	}
 
-	if !strings.Contains(l, WorldLogIdentifier) {
-		return false
-	}
-
-	i, err := NewInstanceByLog(l)
+	i, err := v.patterns.Instance(l, v.location)
 	if err != nil {
 		return false
 	}
-	if i.Time.Before(at) {
+	if !logTimeNotBefore(i.Time, at, v.skew) {
 		return false
 	}
 
-	if v.LatestInstance.ID == i.ID {
+	// 固定したインスタンスには nonce がないことがあるため nonce を除いて比べる
+	if SameInstance(i.ID, v.target().ID) {
 		return false
 	}
 
@@ -463,7 +1123,8 @@ func (v *VRCAutoRejoinTool) isMove(at time.Time, l string) bool {
 }
 
 func (v *VRCAutoRejoinTool) isTimeout(log string) bool {
-	return strings.Contains(log, Timeout)
+	_, ok := v.patterns.Match(EventTimeout, log)
+	return ok
 }
 
 type Exec struct {
@@ -471,39 +1132,37 @@ type Exec struct {
 	Args    []string
 }
 
-var instancePattern = regexp.MustCompile(`vrchat://.+`)
-
-func prepareExecArgs(processArgs string, i Instance) Exec {
-	// 起動時に vrchat:// のインスタンス指定があった場合は競合するため消す
-	if strings.Contains(processArgs, "vrchat://") {
-		processArgs = instancePattern.ReplaceAllString(processArgs, "")
-	}
+// String は Exec を Windows のコマンドラインとして組み立てる
+func (e Exec) String() string {
+	return joinCommandLine(append([]string{e.ExePath}, e.Args...))
+}
 
-	// 既存の起動引数を用いて rejoin するインスタンスを指定する
-	args := processArgs + ` vrchat://launch?id=` + i.ID
+const launchScheme = "vrchat://"
 
-	// 今動いている VRChat.exe までのパスを取得する
-	// go の windows の exec は exe までのパスと引数を完全に別物として扱うため
-	arg := strings.Split(args, `VRChat.exe`)
-	exe := arg[:1][0] + `VRChat.exe`
+func prepareExecArgs(processArgs string, i Instance) Exec {
+	// go の windows の exec は exe までのパスと引数を完全に別物として扱うため argv に分解する
+	argv := splitCommandLine(processArgs)
 
-	// C:\Program Files (x86) などのスペースを含む階層以下にある場合のVRChat.exe のパスは "" で囲まれているため除去する
-	// 末尾の " は exe の組立時に VRChat.exe で追加しているため除去不要
-	if strings.HasPrefix(exe, `"`) {
-		exe = exe[1:]
+	exe := ""
+	if len(argv) > 0 {
+		exe = argv[0]
+		argv = argv[1:]
 	}
 
-	tmpArgs := arg[1:][0]
-
-	// C:\Program Files (x86) 以下の階層にある場合はexeのパスの " がのこるので除去する
-	if strings.HasPrefix(tmpArgs, `"`) {
-		tmpArgs = tmpArgs[1:]
+	// 起動時に vrchat:// のインスタンス指定があった場合は競合するため消す
+	args := make([]string, 0, len(argv)+1)
+	for _, arg := range argv {
+		if strings.HasPrefix(strings.ToLower(arg), launchScheme) {
+			continue
+		}
+		args = append(args, arg)
 	}
 
-	exeArgs := strings.Fields(strings.TrimSpace(tmpArgs))
+	// 既存の起動引数を用いて rejoin するインスタンスを指定する
+	args = append(args, launchScheme+"launch?id="+i.ID)
 
 	return Exec{
 		ExePath: exe,
-		Args:    exeArgs,
+		Args:    args,
 	}
 }
@@ -1,31 +1,23 @@
 package vrcarjt
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"os/exec"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jinzhu/now"
 )
 
-func init() {
-	var err error
-	time.Local, err = time.LoadLocation(Location)
-	if err != nil {
-		time.Local = time.FixedZone(Location, 9*60*60)
-	}
-}
-
 func TestParseLatestInstance(t *testing.T) {
-	loc, err := time.LoadLocation(Location)
-	if err != nil {
-		loc = time.FixedZone(Location, 9*60*60)
-	}
+	loc := time.Local
 
 	t.Run("parse log latest logInspector", func(t *testing.T) {
 		lt, err := time.ParseInLocation("2006.01.02 15:04:05", "2019.08.18 21:02:38", loc)
@@ -203,12 +195,6 @@ func TestMove(t *testing.T) {
 }
 
 func TestMoveWithTofu(t *testing.T) {
-	var err error
-	time.Local, err = time.LoadLocation(Location)
-	if err != nil {
-		time.Local = time.FixedZone(Location, 9*60*60)
-	}
-
 	freeze := time.Date(2018, 1, 1, 0, 0, 0, 0, time.Local)
 
 	t.Run("success case", func(t *testing.T) {
@@ -306,10 +292,7 @@ func TestFindProcessByName(t *testing.T) {
 
 func TestInTimeRange(t *testing.T) {
 
-	loc, err := time.LoadLocation(Location)
-	if err != nil {
-		loc = time.FixedZone(Location, 9*60*60)
-	}
+	loc := time.Local
 	tests := []struct {
 		start   string
 		end     string
@@ -337,7 +320,7 @@ func TestInTimeRange(t *testing.T) {
 func TestTime(t *testing.T) {
 	loc, err := time.LoadLocation("local")
 	if err != nil {
-		loc = time.FixedZone(Location, 9*60*60)
+		loc = time.FixedZone("JST", 9*60*60)
 	}
 	tests := []struct {
 		check   string
@@ -412,15 +395,246 @@ func TestPrepareExecArgs(t *testing.T) {
 				Args:    []string{"--no-vr", "--enable-sdk-log-levels", "vrchat://launch?id=wrld_d95af561-c0d2-4000-b269-7e1913aec432:10484~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~nonce(DCB2E2BB993B9AA1728DD0EC66803F1F575C00940BB2EFF3E2EAAC115B33DF49)"},
 			},
 		},
+
+		{
+			"Has quoted args with space",
+			`"C:\Program Files (x86)\Steam\steamapps\common\VRChat\VRChat.exe" --profile=1 --midi="My Device" "--osc=9000:127.0.0.1:9001"`,
+			Instance{
+				ID: `wrld_cc124ed6-acec-4d55-9866-54ab66af172d`,
+			},
+			Exec{
+				ExePath: `C:\Program Files (x86)\Steam\steamapps\common\VRChat\VRChat.exe`,
+				Args:    []string{"--profile=1", "--midi=My Device", "--osc=9000:127.0.0.1:9001", "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+			},
+		},
+
+		{
+			"Has arg contains VRChat.exe",
+			`"D:\Games\VRChat.exe\VRChat.exe" --log-debug-levels "--mod-dir=D:\Mods\VRChat.exe backup"`,
+			Instance{
+				ID: `wrld_cc124ed6-acec-4d55-9866-54ab66af172d`,
+			},
+			Exec{
+				ExePath: `D:\Games\VRChat.exe\VRChat.exe`,
+				Args:    []string{"--log-debug-levels", `--mod-dir=D:\Mods\VRChat.exe backup`, "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+			},
+		},
+
+		{
+			"Has quoted instance in the middle",
+			`S:\SteamLibrary\steamapps\common\VRChat\VRChat.exe "vrchat://launch?id=wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)" --no-vr`,
+			Instance{
+				ID: `wrld_cc124ed6-acec-4d55-9866-54ab66af172d`,
+			},
+			Exec{
+				ExePath: `S:\SteamLibrary\steamapps\common\VRChat\VRChat.exe`,
+				Args:    []string{"--no-vr", "vrchat://launch?id=wrld_cc124ed6-acec-4d55-9866-54ab66af172d"},
+			},
+		},
 	}
 
 	for _, test := range tests {
 		res := prepareExecArgs(test.ProcessArgs, test.Instance)
 		if !reflect.DeepEqual(res, test.Expect) {
-			t.Log(t.Name(), "failed")
+			t.Log(test.Name, "failed")
 			t.Errorf("doesnt match \nexpect %q \ngot %q", test.Expect, res)
 		}
 
 	}
 
 }
+
+func TestParseInstanceID(t *testing.T) {
+	tests := []struct {
+		ID     string
+		Expect InstanceID
+	}{
+		{
+			`wrld_cc124ed6-acec-4d55-9866-54ab66af172d`,
+			InstanceID{WorldID: "wrld_cc124ed6-acec-4d55-9866-54ab66af172d", AccessType: "public"},
+		},
+		{
+			`wrld_7344b9f5-06e1-4e30-bede-fde72d2e5455:37969~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~canRequestInvite~nonce(3A7A1F9FFE3F87C45D978535DADD3CEFB007D9249366A1BCED70A96FD4740D3C)`,
+			InstanceID{
+				WorldID:    "wrld_7344b9f5-06e1-4e30-bede-fde72d2e5455",
+				Name:       "37969",
+				AccessType: "invite+",
+				Owner:      "usr_d97adcdc-718b-4361-9b75-2c97c0a4993d",
+				Nonce:      "3A7A1F9FFE3F87C45D978535DADD3CEFB007D9249366A1BCED70A96FD4740D3C",
+				Tags:       []string{"private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)", "canRequestInvite"},
+			},
+		},
+		{
+			`wrld_9c72e56b-d2b0-4c9b-b816-07a857f6ae4e:77980~hidden(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)~region(jp)~nonce(dd)`,
+			InstanceID{
+				WorldID:    "wrld_9c72e56b-d2b0-4c9b-b816-07a857f6ae4e",
+				Name:       "77980",
+				AccessType: "friends+",
+				Owner:      "usr_32859244-ec08-40ec-a84e-f6fbafda1e42",
+				Region:     "jp",
+				Nonce:      "dd",
+				Tags:       []string{"hidden(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)", "region(jp)"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got, err := ParseInstanceID(test.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, test.Expect) {
+			t.Errorf("doesnt match \nexpect %+v \ngot %+v", test.Expect, got)
+		}
+		if got.String() != test.ID {
+			t.Errorf("doesnt match \nexpect %s \ngot %s", test.ID, got.String())
+		}
+	}
+
+	for _, id := range []string{"", "usr_d97adcdc-718b-4361-9b75-2c97c0a4993d", "wrld_cc124ed6:1~private(usr_x"} {
+		if _, err := ParseInstanceID(id); err == nil {
+			t.Errorf("%q must be invalid", id)
+		}
+	}
+}
+
+func TestNewInstance(t *testing.T) {
+	const owner = "usr_d97adcdc-718b-4361-9b75-2c97c0a4993d"
+	tests := []struct {
+		id     string
+		owner  string
+		expect string
+		ok     bool
+	}{
+		{"wrld_cc124ed6-acec-4d55-9866-54ab66af172d:77980~region(jp)~nonce(dd)", "", "~region(jp)", true},
+		{"wrld_cc124ed6-acec-4d55-9866-54ab66af172d:77980~hidden(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)~region(jp)", owner, "~hidden(" + owner + ")~region(jp)", true},
+		{"wrld_cc124ed6-acec-4d55-9866-54ab66af172d:77980~private(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)~canRequestInvite~region(us)", owner, "~private(" + owner + ")~canRequestInvite~region(us)", true},
+		{"wrld_cc124ed6-acec-4d55-9866-54ab66af172d:77980~friends(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)", "", "", false},
+		{"wrld_cc124ed6-acec-4d55-9866-54ab66af172d:77980~group(grp_6f3f5b8e-2a83-4d39-9d16-9a5c4d3a1f1e)~groupAccessType(public)", owner, "", false},
+	}
+	for _, test := range tests {
+		id, err := ParseInstanceID(test.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, ok := id.NewInstance(rand.New(rand.NewSource(1)), test.owner)
+		if ok != test.ok {
+			t.Errorf("%s expect %v got %v", test.id, test.ok, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if got := strings.TrimPrefix(n.String(), id.WorldID+":"+n.Name); got != test.expect || n.Name == id.Name {
+			t.Errorf("%s expect tags %q got %q", test.id, test.expect, n.String())
+		}
+	}
+}
+
+func TestRejoinFallback(t *testing.T) {
+	original := `wrld_9c72e56b-d2b0-4c9b-b816-07a857f6ae4e:77980~hidden(usr_32859244-ec08-40ec-a84e-f6fbafda1e42)~region(jp)~nonce(dd)`
+	fallbackWorld := `wrld_4cf554b4-430c-4f8f-b53e-1f294eed230b`
+
+	v := newVRCAutoRejoinTool(&Setting{FallbackNewInstance: true, FallbackWorlds: []string{fallbackWorld}})
+	v.LatestInstance = Instance{ID: original}
+	v.roster.observe("2021.02.14 00:59:50 Log        -  User Authenticated: bootjp (usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)")
+
+	target, ok := v.rejoinTarget()
+	if !ok || target.ID != original {
+		t.Fatalf("first target must be the original instance %v", target)
+	}
+
+	// 元のインスタンスが閉じていてホームに戻された
+	if v.verifyRejoin(Instance{ID: "wrld_4432ea9b-729c-46e3-8eaf-846aa0a37fdd"}) {
+		t.Fatal("verification must fail at home")
+	}
+	target, ok = v.rejoinTarget()
+	id, err := ParseInstanceID(target.ID)
+	if !ok || err != nil {
+		t.Fatalf("second target must be a new instance %v %v", target, err)
+	}
+	if id.WorldID != "wrld_9c72e56b-d2b0-4c9b-b816-07a857f6ae4e" || id.AccessType != "friends+" || id.Region != "jp" || id.Nonce != "" || id.Name == "77980" {
+		t.Errorf("new instance must keep world, access type and region %+v", id)
+	}
+	if id.Owner != "usr_d97adcdc-718b-4361-9b75-2c97c0a4993d" {
+		t.Errorf("new instance must be owned by the local user %+v", id)
+	}
+
+	if v.verifyRejoin(Instance{ID: "wrld_4432ea9b-729c-46e3-8eaf-846aa0a37fdd"}) {
+		t.Fatal("verification must fail at home")
+	}
+	if target, ok = v.rejoinTarget(); !ok || target.ID != fallbackWorld {
+		t.Fatalf("third target must be the fallback world %v", target)
+	}
+
+	arrived := Instance{ID: fallbackWorld + ":12345"}
+	if !v.verifyRejoin(arrived) {
+		t.Fatal("verification must succeed in the fallback world")
+	}
+	if target, ok = v.rejoinTarget(); !ok || target != arrived {
+		t.Fatalf("arrived instance must be the next target %v", target)
+	}
+
+	v.verifyRejoin(Instance{ID: "wrld_4432ea9b-729c-46e3-8eaf-846aa0a37fdd"})
+	v.verifyRejoin(Instance{ID: "wrld_4432ea9b-729c-46e3-8eaf-846aa0a37fdd"})
+	v.verifyRejoin(Instance{ID: "wrld_4432ea9b-729c-46e3-8eaf-846aa0a37fdd"})
+	if _, ok = v.rejoinTarget(); ok {
+		t.Fatal("must stay after all fallbacks failed")
+	}
+}
+
+func TestNewInstanceByLogMalformed(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Log    string
+		Expect error
+	}{
+		{"short", `2019.08.18`, ErrShortLogLine},
+		{"short with identifier", `2019.08 wrld_`, ErrShortLogLine},
+		{"invalid utf-8", "2019.08.18 21:02:38 Log        -  [VRCFlowManagerVRC] Destination set: wrld_\xff\xfe", ErrInvalidLogEncoding},
+		{"no world", `2019.08.18 21:02:38 Log        -  [VRCFlowManagerVRC] Destination set: `, ErrWorldLogNotFound},
+		{"control character", "2019.08.18 21:02:38 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6\x01acec", ErrMalformedLogLine},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			_, err := NewInstanceByLog(test.Log)
+			if !errors.Is(err, test.Expect) {
+				t.Errorf("expect %v got %v", test.Expect, err)
+			}
+		})
+	}
+
+	t.Run("garbled time", func(t *testing.T) {
+		if _, err := NewInstanceByLog(`20xx.08.18 21:02:38 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d`); err == nil {
+			t.Error("must be error")
+		}
+	})
+
+	t.Run("trailing nul and cr", func(t *testing.T) {
+		got, err := NewInstanceByLog("2019.08.18 21:02:38 Log        -  [VRCFlowManagerVRC] Destination set: wrld_cc124ed6-acec-4d55-9866-54ab66af172d\x00\x00\r")
+		if err != nil || got.ID != "wrld_cc124ed6-acec-4d55-9866-54ab66af172d" {
+			t.Errorf("got %v %v", got, err)
+		}
+	})
+}
+
+func TestParseLatestInstanceGarbled(t *testing.T) {
+	content, err := ioutil.ReadFile(".test_data/garbled.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, err := time.ParseInLocation(TimeFormat, "2021.02.14 10:12:50", time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := Instance{Time: lt, ID: "wrld_58260f57-0076-41d3-a617-c0d0bc8f3d6f:43710~private(usr_d97adcdc-718b-4361-9b75-2c97c0a4993d)~nonce(86CB2A7F4E4AC916CD5A1313F656863C1E80BD2ED63738EA789E2B4C25B48F39)"}
+
+	got, err := NewVRCAutoRejoinTool().parseLatestInstance(string(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != expect {
+		t.Errorf("doesnt match \nexpect %v \ngot %v", expect, got)
+	}
+}
@@ -0,0 +1,218 @@
+package vrcarjt
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/process"
+)
+
+// clock はテストで時間を進められるようにするための時計
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// processSampler は監視している VRChat.exe の状態を読む
+type processSampler interface {
+	// CPUTime はプロセスが起動してから使った CPU 時間の合計
+	CPUTime() (time.Duration, error)
+	// RSS は使っている物理メモリのバイト数
+	RSS() (uint64, error)
+	Started() (time.Time, error)
+}
+
+type gopsutilProcess struct {
+	p *process.Process
+}
+
+func newProcessSampler(pid int32) (processSampler, error) {
+	p, err := process.NewProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &gopsutilProcess{p: p}, nil
+}
+
+func (g *gopsutilProcess) CPUTime() (time.Duration, error) {
+	t, err := g.p.Times()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration((t.User + t.System) * float64(time.Second)), nil
+}
+
+func (g *gopsutilProcess) RSS() (uint64, error) {
+	m, err := g.p.MemoryInfo()
+	if err != nil {
+		return 0, err
+	}
+	return m.RSS, nil
+}
+
+func (g *gopsutilProcess) Started() (time.Time, error) {
+	ms, err := g.p.CreateTime()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), nil
+}
+
+const hangCheckInterval = 10 * time.Second
+
+// hangWatchdog はプロセスが残ったまま固まった VRChat を検出する
+// ログが logSilence の間出力されない, または CPU 使用率が cpuThreshold 以下の状態が cpuIdle の間続いたときに固まったとみなす
+type hangWatchdog struct {
+	clock        clock
+	logSilence   time.Duration
+	cpuIdle      time.Duration
+	cpuThreshold float64
+
+	lock       *sync.Mutex
+	lastLog    time.Time
+	idleSince  time.Time
+	lastCPU    time.Duration
+	lastSample time.Time
+}
+
+func newHangWatchdog(c clock, conf *Setting) *hangWatchdog {
+	now := c.Now()
+	return &hangWatchdog{
+		clock:        c,
+		logSilence:   time.Duration(conf.HangLogSilenceMinutes) * time.Minute,
+		cpuIdle:      time.Duration(conf.HangCPUIdleMinutes) * time.Minute,
+		cpuThreshold: conf.HangCPUThreshold,
+		lock:         &sync.Mutex{},
+		lastLog:      now,
+		idleSince:    now,
+	}
+}
+
+func (h *hangWatchdog) enabled() bool {
+	return h.logSilence > 0 || h.cpuIdle > 0
+}
+
+// logReceived はログが 1 行出力されるたびに呼ぶ
+func (h *hangWatchdog) logReceived() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastLog = h.clock.Now()
+}
+
+// check は p の CPU 時間を記録して, 固まっていればその理由を返す
+func (h *hangWatchdog) check(p processSampler) (string, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	now := h.clock.Now()
+
+	if h.logSilence > 0 && now.Sub(h.lastLog) >= h.logSilence {
+		return fmt.Sprintf("no log output for %s", now.Sub(h.lastLog)), true
+	}
+
+	if h.cpuIdle <= 0 {
+		return "", false
+	}
+	cpu, err := p.CPUTime()
+	if err != nil {
+		// CPU 時間が取れないときは判定しない
+		h.idleSince = now
+		return "", false
+	}
+	if !h.lastSample.IsZero() && now.After(h.lastSample) {
+		percent := float64(cpu-h.lastCPU) / float64(now.Sub(h.lastSample)) * 100
+		if percent > h.cpuThreshold {
+			h.idleSince = now
+		}
+	} else {
+		h.idleSince = now
+	}
+	h.lastCPU = cpu
+	h.lastSample = now
+
+	if now.Sub(h.idleSince) >= h.cpuIdle {
+		return fmt.Sprintf("cpu usage below %.1f%% for %s", h.cpuThreshold, now.Sub(h.idleSince)), true
+	}
+	return "", false
+}
+
+// wait は固まったことを検出するか watching が false を返すまで待つ
+func (h *hangWatchdog) wait(p processSampler, watching func() bool) (string, bool) {
+	for watching() {
+		if reason, hung := h.check(p); hung {
+			return reason, true
+		}
+		h.clock.Sleep(hangCheckInterval)
+	}
+	return "", false
+}
+
+const memoryCheckInterval = time.Minute
+
+// memoryWatchdog は使っているメモリが limit を超えるか, 起動から maxAge が経った VRChat を
+// allowed の時間帯に計画的に再起動させる
+type memoryWatchdog struct {
+	clock   clock
+	limit   uint64
+	maxAge  time.Duration
+	allowed *timeWindow
+}
+
+func newMemoryWatchdog(c clock, conf *Setting) (*memoryWatchdog, error) {
+	m := &memoryWatchdog{
+		clock:  c,
+		limit:  uint64(conf.RestartMemoryMB) * 1024 * 1024,
+		maxAge: time.Duration(conf.RestartAfterHours * float64(time.Hour)),
+	}
+	if conf.RestartAllowedHours != "" {
+		w, err := parseTimeWindow(conf.RestartAllowedHours)
+		if err != nil {
+			return nil, err
+		}
+		m.allowed = w
+	}
+	return m, nil
+}
+
+func (m *memoryWatchdog) enabled() bool {
+	return m.limit > 0 || m.maxAge > 0
+}
+
+// check は再起動が必要であればその理由を返す
+func (m *memoryWatchdog) check(p processSampler) (string, bool) {
+	now := m.clock.Now()
+	if m.allowed != nil && !m.allowed.contains(now) {
+		return "", false
+	}
+
+	if m.limit > 0 {
+		rss, err := p.RSS()
+		if err == nil && rss >= m.limit {
+			return fmt.Sprintf("memory usage %dMB exceeded %dMB", rss/1024/1024, m.limit/1024/1024), true
+		}
+	}
+
+	if m.maxAge > 0 {
+		started, err := p.Started()
+		if err == nil && now.Sub(started) >= m.maxAge {
+			return fmt.Sprintf("process has been up for %s", now.Sub(started).Truncate(time.Minute)), true
+		}
+	}
+	return "", false
+}
+
+// wait は再起動が必要になるか watching が false を返すまで待つ
+func (m *memoryWatchdog) wait(p processSampler, watching func() bool) (string, bool) {
+	for watching() {
+		if reason, restart := m.check(p); restart {
+			return reason, true
+		}
+		m.clock.Sleep(memoryCheckInterval)
+	}
+	return "", false
+}
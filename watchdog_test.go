@@ -0,0 +1,203 @@
+package vrcarjt
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time        { return c.now }
+func (c *fakeClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
+
+// fakeProcess は呼ばれるたびに cpuPerCall の CPU 時間を使ったことにする
+type fakeProcess struct {
+	cpu        time.Duration
+	cpuPerCall time.Duration
+	rss        uint64
+	started    time.Time
+	err        error
+}
+
+func (p *fakeProcess) CPUTime() (time.Duration, error) {
+	p.cpu += p.cpuPerCall
+	return p.cpu, p.err
+}
+
+func (p *fakeProcess) RSS() (uint64, error) {
+	return p.rss, p.err
+}
+
+func (p *fakeProcess) Started() (time.Time, error) {
+	return p.started, p.err
+}
+
+func TestHangWatchdog(t *testing.T) {
+	start := time.Date(2021, 2, 14, 2, 0, 0, 0, time.Local)
+
+	t.Run("disabled", func(t *testing.T) {
+		h := newHangWatchdog(&fakeClock{now: start}, &Setting{HangCPUThreshold: 1})
+		if h.enabled() {
+			t.Error("must be disabled without thresholds")
+		}
+	})
+
+	t.Run("log silence", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		h := newHangWatchdog(c, &Setting{HangLogSilenceMinutes: 5})
+		p := &fakeProcess{cpuPerCall: time.Second}
+
+		c.Sleep(4 * time.Minute)
+		h.logReceived()
+		c.Sleep(4 * time.Minute)
+		if _, hung := h.check(p); hung {
+			t.Error("must not be hung while log is written")
+		}
+
+		reason, hung := h.wait(p, func() bool { return true })
+		if !hung || !strings.HasPrefix(reason, "no log output") {
+			t.Errorf("must be hung by log silence %q", reason)
+		}
+		if elapsed := c.now.Sub(start); elapsed < 9*time.Minute || elapsed > 10*time.Minute {
+			t.Errorf("detected at unexpected time %s", elapsed)
+		}
+	})
+
+	t.Run("cpu idle", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		h := newHangWatchdog(c, &Setting{HangCPUIdleMinutes: 3, HangCPUThreshold: 1})
+		// 10 秒ごとに 1 秒 (10%) 使っている間は固まっていない
+		p := &fakeProcess{cpuPerCall: time.Second}
+		for i := 0; i < 60; i++ {
+			if _, hung := h.check(p); hung {
+				t.Fatal("must not be hung while cpu is used")
+			}
+			c.Sleep(hangCheckInterval)
+		}
+
+		// 10 秒ごとに 10ms (0.1%) しか使わなくなったら固まっている
+		p.cpuPerCall = 10 * time.Millisecond
+		idle := c.now
+		reason, hung := h.wait(p, func() bool { return true })
+		if !hung || !strings.HasPrefix(reason, "cpu usage below") {
+			t.Errorf("must be hung by cpu idle %q", reason)
+		}
+		if elapsed := c.now.Sub(idle); elapsed < 3*time.Minute-hangCheckInterval || elapsed > 3*time.Minute+hangCheckInterval {
+			t.Errorf("detected at unexpected time %s", elapsed)
+		}
+	})
+
+	t.Run("cpu time unavailable", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		h := newHangWatchdog(c, &Setting{HangCPUIdleMinutes: 1, HangCPUThreshold: 1})
+		p := &fakeProcess{err: errors.New("access denied")}
+		for i := 0; i < 30; i++ {
+			if _, hung := h.check(p); hung {
+				t.Fatal("must not be hung without cpu time")
+			}
+			c.Sleep(hangCheckInterval)
+		}
+	})
+
+	t.Run("stop watching", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		h := newHangWatchdog(c, &Setting{HangLogSilenceMinutes: 5})
+		count := 0
+		_, hung := h.wait(&fakeProcess{}, func() bool {
+			count++
+			return count < 3
+		})
+		if hung {
+			t.Error("must not be hung after watching stopped")
+		}
+	})
+}
+
+func TestMemoryWatchdog(t *testing.T) {
+	start := time.Date(2021, 2, 14, 23, 0, 0, 0, time.Local)
+
+	t.Run("invalid allowed hours", func(t *testing.T) {
+		if _, err := newMemoryWatchdog(&fakeClock{now: start}, &Setting{RestartAllowedHours: "3-5"}); err == nil {
+			t.Error("must be error")
+		}
+	})
+
+	t.Run("memory limit in allowed hours", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		m, err := newMemoryWatchdog(c, &Setting{RestartMemoryMB: 8192, RestartAllowedHours: "03:00-05:00"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := &fakeProcess{rss: 9 * 1024 * 1024 * 1024, started: start}
+
+		reason, restart := m.wait(p, func() bool { return true })
+		if !restart || !strings.HasPrefix(reason, "memory usage 9216MB") {
+			t.Errorf("must restart by memory %q", reason)
+		}
+		if c.now.Hour() != 3 || c.now.Minute() != 0 {
+			t.Errorf("must wait until allowed hours %s", c.now)
+		}
+	})
+
+	t.Run("under memory limit", func(t *testing.T) {
+		m, err := newMemoryWatchdog(&fakeClock{now: start}, &Setting{RestartMemoryMB: 8192})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, restart := m.check(&fakeProcess{rss: 4 * 1024 * 1024 * 1024}); restart {
+			t.Error("must not restart under limit")
+		}
+	})
+
+	t.Run("max age", func(t *testing.T) {
+		c := &fakeClock{now: start}
+		m, err := newMemoryWatchdog(c, &Setting{RestartAfterHours: 6})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reason, restart := m.wait(&fakeProcess{started: start.Add(-time.Hour)}, func() bool { return true })
+		if !restart || reason != "process has been up for 6h0m0s" {
+			t.Errorf("must restart by age %q", reason)
+		}
+	})
+}
+
+func TestTimeWindow(t *testing.T) {
+	tests := []struct {
+		window  string
+		check   string
+		inRange bool
+	}{
+		{"05:45-08:00", "04:00", false},
+		{"05:45-08:00", "05:45", true},
+		{"05:45-08:00", "08:00", true},
+		{"05:45-08:00", "08:01", false},
+		{"23:00-05:00", "23:30", true},
+		{"23:00-05:00", "03:00", true},
+		{"23:00-05:00", "12:00", false},
+	}
+	for _, test := range tests {
+		w, err := parseTimeWindow(test.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check, _ := time.ParseInLocation("15:04", test.check, time.Local)
+		if w.contains(check) != test.inRange {
+			t.Errorf("%s %s expect %v", test.window, test.check, test.inRange)
+		}
+	}
+
+	// 夏時間が始まる日は 0 時からの経過時間と時計の時刻が 1 時間ずれる
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	w, _ := parseTimeWindow("06:00-07:00")
+	if check := time.Date(2021, 3, 14, 6, 30, 0, 0, loc); !w.contains(check) {
+		t.Errorf("06:00-07:00 must contain %v", check)
+	}
+}